@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dg1psi/shuttlemidi/devices"
+)
+
+// APIConfig contains the configuration of the local HTTP API
+type APIConfig struct {
+	// Enabled starts the HTTP API
+	Enabled bool
+	// Address is the local address the HTTP API listens on. Only loopback addresses are allowed
+	Address string
+	// Token has to be sent by clients as bearer token in the Authorization header
+	Token string
+	// Stream enables the WebSocket endpoint /events streaming the ShuttlExpress events and the commands sent
+	Stream bool
+}
+
+// validate checks that the API is only reachable locally and protected by a token
+func (api *APIConfig) validate() error {
+	if !api.Enabled {
+		return nil
+	}
+	if api.Token == "" {
+		return errors.New("API.Token must be set if the API is enabled")
+	}
+	host, _, err := net.SplitHostPort(api.Address)
+	if err != nil {
+		return fmt.Errorf("invalid API.Address: %v", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("API.Address %v is not a loopback address", api.Address)
+	}
+	return nil
+}
+
+// apiCommand is the JSON representation of a devices.Command accepted by the /send endpoint
+type apiCommand struct {
+	Type    devices.MessageType `json:"type"`
+	Channel uint8               `json:"channel"`
+	Data1   uint8               `json:"data1"`
+	Data2   uint8               `json:"data2"`
+	Bend    int16               `json:"bend"`
+	Repeat  bool                `json:"repeat"`
+	Delay   string              `json:"delay"`
+}
+
+// validate checks the ranges of the command. A channel of 0 or a missing channel uses the channel of the MIDI device
+func (ac *apiCommand) validate() error {
+	if ac.Type > devices.PitchBend {
+		return fmt.Errorf("unknown message type %d", uint8(ac.Type))
+	}
+	if ac.Channel > 16 {
+		return fmt.Errorf("channel %v is outside of the range 1 to 16", ac.Channel)
+	}
+	if ac.Data1 > 127 || ac.Data2 > 127 {
+		return fmt.Errorf("data1 %v or data2 %v is outside of the range 0 to 127", ac.Data1, ac.Data2)
+	}
+	if ac.Bend < -8192 || ac.Bend > 8191 {
+		return fmt.Errorf("bend %v is outside of the range -8192 to 8191", ac.Bend)
+	}
+	return nil
+}
+
+// apiRepeat is the JSON representation of a devices.RepeatState returned by the /status endpoint
+type apiRepeat struct {
+	Name      string              `json:"name"`
+	Type      devices.MessageType `json:"type"`
+	Channel   uint8               `json:"channel"`
+	Data1     uint8               `json:"data1"`
+	Data2     uint8               `json:"data2"`
+	Remaining int                 `json:"remaining"`
+}
+
+// apiStatus is the JSON representation of the application state returned by the /status endpoint
+type apiStatus struct {
+	Device  string      `json:"device"`
+	Serial  string      `json:"serial"`
+	Port    string      `json:"port"`
+	Dropped uint64      `json:"dropped"`
+	Repeats []apiRepeat `json:"repeats"`
+}
+
+// apiPresets is the JSON representation of the presets returned by the /presets endpoint
+type apiPresets struct {
+	Presets []string `json:"presets"`
+	Active  string   `json:"active"`
+}
+
+// apiSelectPreset is the JSON request of the /presets endpoint selecting a preset
+type apiSelectPreset struct {
+	Name string `json:"name"`
+}
+
+// authenticate only passes requests with a valid bearer token to the handler. Browsers can't set the header for a
+// WebSocket, so the token is also accepted as query parameter token of a WebSocket upgrade
+func authenticate(token string, handler http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") && r.URL.Query().Get("token") != "" {
+			auth = "Bearer " + r.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(auth), expected) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// handleSend sends the MIDI message posted as JSON through the MidiController returned by controller
+func handleSend(controller func() devices.MidiController) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var ac apiCommand
+		if err := json.NewDecoder(r.Body).Decode(&ac); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := ac.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cmd := devices.Command{Name: "API", Type: ac.Type, Channel: ac.Channel, Data1: ac.Data1, Data2: ac.Data2, Bend: ac.Bend, Repeat: ac.Repeat}
+		if ac.Delay != "" {
+			delay, err := time.ParseDuration(ac.Delay)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			cmd.Delay = delay
+		}
+
+		mc := controller()
+		if mc == nil {
+			http.Error(w, devices.ErrMIDIDeviceNotInitialized.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err := mc.Send(cmd); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleStatus returns the ShuttlExpress, the MIDI device and the currently repeated commands as JSON
+func handleStatus(controller func() devices.MidiController, shuttle func() *devices.ShuttlExpress) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		status := apiStatus{Repeats: []apiRepeat{}}
+		if se := shuttle(); se != nil {
+			info := se.DeviceInfo()
+			status.Device = info.Product
+			status.Serial = info.Serial
+		}
+		if mc := controller(); mc != nil {
+			status.Port = mc.Port()
+			status.Dropped = mc.Dropped()
+			for _, rs := range mc.Repeats() {
+				c := rs.Command
+				status.Repeats = append(status.Repeats, apiRepeat{Name: c.Name, Type: c.Type, Channel: c.Channel, Data1: c.Data1, Data2: c.Data2, Remaining: rs.Remaining})
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// handlePresets returns the names of all presets and the active one as JSON on GET. A POST selects the preset named in
+// the JSON request through selectPreset
+func handlePresets(activePreset func() string, selectPreset func(name string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(apiPresets{Presets: presetNames(), Active: activePreset()})
+		case http.MethodPost:
+			var sp apiSelectPreset
+			if err := json.NewDecoder(r.Body).Decode(&sp); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if _, ok := findPreset(sp.Name); !ok {
+				http.Error(w, "unknown preset "+sp.Name, http.StatusNotFound)
+				return
+			}
+			if err := selectPreset(sp.Name); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// startAPI starts the local HTTP API for sending MIDI messages through controller, querying the state of shuttle and
+// selecting presets like the tray menu. If Stream is set, /events streams the events and commands
+func startAPI(cfg APIConfig, controller func() devices.MidiController, shuttle func() *devices.ShuttlExpress,
+	activePreset func() string, selectPreset func(name string) error) {
+	mux := http.NewServeMux()
+	mux.Handle("/send", handleSend(controller))
+	mux.Handle("/status", handleStatus(controller, shuttle))
+	mux.Handle("/presets", handlePresets(activePreset, selectPreset))
+	if cfg.Stream {
+		mux.Handle("/events", handleEvents(stream))
+	}
+
+	go func() {
+		fmt.Printf("Starting API on %v\n", cfg.Address)
+		if err := http.ListenAndServe(cfg.Address, authenticate(cfg.Token, mux)); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+	}()
+}
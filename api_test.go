@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dg1psi/shuttlemidi/devices"
+)
+
+func TestHandleSendValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"control change", `{"type":"ControlChange","data1":3,"data2":127}`, http.StatusServiceUnavailable},
+		{"note on channel 16", `{"type":"NoteOn","channel":16,"data1":60,"data2":100}`, http.StatusServiceUnavailable},
+		{"note on channel 17", `{"type":"NoteOn","channel":17,"data1":60,"data2":100}`, http.StatusBadRequest},
+		{"control change channel 200", `{"type":"ControlChange","channel":200,"data1":3}`, http.StatusBadRequest},
+		{"controller 128", `{"type":"ControlChange","data1":128}`, http.StatusBadRequest},
+		{"value 255", `{"type":"ControlChange","data1":3,"data2":255}`, http.StatusBadRequest},
+		{"unknown type name", `{"type":"SysEx"}`, http.StatusBadRequest},
+		{"unknown type number", `{"type":7}`, http.StatusBadRequest},
+		{"bend", `{"type":"PitchBend","bend":9000}`, http.StatusBadRequest},
+	}
+	// without a controller, a valid command fails with 503 after the validation
+	handler := handleSend(func() devices.MidiController { return nil })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(tt.body)))
+			if rec.Code != tt.code {
+				t.Errorf("status %v, expected %v: %v", rec.Code, tt.code, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dg1psi/shuttlemidi/devices"
+)
+
+// BackendConfig contains the configuration of an additional named output backend, which can be selected by mappings
+type BackendConfig struct {
+	// URL specifies the backend as URL, e.g. midi://loopMIDI%20Port?channel=2 or osc://127.0.0.1:9000/midi (see
+	// devices.NewController). If it is set, MidiDevice and MidiChannel are ignored
+	URL string
+	// MidiDevice is the name of the MIDI output device of the backend
+	MidiDevice string
+	// MidiChannel is the MIDI channel (1-16) used by the backend
+	MidiChannel uint8
+}
+
+// channel returns the MIDI channel (1-16) of the backend. MidiChannel isn't used by URL backends, their channel is set
+// by the channel parameter of the URL, which defaults to 1
+func (bc BackendConfig) channel() uint8 {
+	if bc.URL == "" {
+		return bc.MidiChannel
+	}
+	// the URL isn't parsed as a whole, as the device name of midi:// URLs isn't a valid host
+	if i := strings.Index(bc.URL, "?"); i >= 0 {
+		q, _ := url.ParseQuery(bc.URL[i+1:])
+		if c, err := strconv.Atoi(q.Get("channel")); err == nil && c >= 1 && c <= 16 {
+			return uint8(c)
+		}
+	}
+	return 1
+}
+
+// backends contains all opened output backends by their lower case name
+var backends map[string]devices.MidiController
+
+// openBackends opens the output backends of the configuration with the options and returns a registry of all backends
+// opened successfully, keyed by their lower case name. Backends which can't be opened are logged and skipped. A stalled
+// backend calls reconnect like the MIDI device. The caller must hold listenersMu
+func openBackends(cfg *Config, options devices.MidiOptions, reconnect func(what string, current func() bool)) map[string]devices.MidiController {
+	backends = make(map[string]devices.MidiController, len(cfg.Backends))
+	outputs := make(map[string]devices.MidiController, len(cfg.Backends)+1)
+	for name, bc := range cfg.Backends {
+		var b devices.MidiController
+		key, what := strings.ToLower(name), "Backend "+name
+		options.OnStall = func() { reconnect(what, func() bool { return backends[key] == b }) }
+		b, err := newBackend(bc, options)
+		if err != nil {
+			fmt.Printf("Error: unable to create backend %v: %v\n", name, err)
+			continue
+		}
+		if err := b.Open(); err != nil {
+			fmt.Printf("Error: unable to open backend %v: %v\n", name, err)
+			continue
+		}
+		backends[key] = b
+		outputs[key] = b
+	}
+	return outputs
+}
+
+// newBackend creates the controller of the backend from its URL, whose parameters override the options, or from its
+// MIDI device and channel
+func newBackend(bc BackendConfig, options devices.MidiOptions) (devices.MidiController, error) {
+	if bc.URL != "" {
+		return devices.NewControllerWithOptions(bc.URL, options)
+	}
+	return devices.NewMIDIController(nil, bc.MidiDevice, 100*time.Millisecond, bc.MidiChannel-1, options), nil
+}
+
+// closeBackends closes all output backends opened by openBackends
+func closeBackends() {
+	for _, b := range backends {
+		b.Close()
+	}
+	backends = nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/dg1psi/shuttlemidi/devices"
+	"github.com/dg1psi/shuttlemidi/mapping"
+	"github.com/gen2brain/dlgs"
+	"github.com/spf13/viper"
+)
+
+// errCalibrationCanceled is returned by calibrateWheel if the user canceled the calibration
+var errCalibrationCanceled = errors.New("calibration canceled")
+
+// trackWheel subscribes to the events of the ShuttlExpress until quitch is closed and returns a function reporting the
+// last wheel position. The subscription replaces the one of the Mapper, which must be stopped before
+func trackWheel(se *devices.ShuttlExpress, quitch chan struct{}) func() int8 {
+	position := int32(se.WheelPosition())
+	events, _ := se.Subscribe(quitch)
+	go func() {
+		for {
+			select {
+			case e := <-events:
+				if e.Control == devices.Wheel {
+					atomic.StoreInt32(&position, int32(e.Value))
+				}
+			case <-quitch:
+				return
+			}
+		}
+	}()
+	return func() int8 { return int8(atomic.LoadInt32(&position)) }
+}
+
+// recordWheelPosition asks the user to hold the wheel in the given direction and returns the position reported by wheel
+func recordWheelPosition(wheel func() int8, direction string) (int8, error) {
+	ok, err := dlgs.Question(applicationName, "Turn the wheel fully "+direction+" and hold it there, then press Yes.", false)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, errCalibrationCanceled
+	}
+	return wheel(), nil
+}
+
+// calibrateWheel guides the user through the calibration of the wheel. The positions reported at both extremes are
+// recorded and WheelMax, WheelReverse and the steps of the wheel mappings are written to the configuration, so the
+// full deflection of the wheel results in the controller value 127. The listeners must be stopped before, the events of
+// the ShuttlExpress are received by the calibration until it returns
+func calibrateWheel(se *devices.ShuttlExpress) error {
+	quitch := make(chan struct{})
+	defer close(quitch)
+	wheel := trackWheel(se, quitch)
+
+	cw, err := recordWheelPosition(wheel, "clockwise")
+	if err != nil {
+		return err
+	}
+	ccw, err := recordWheelPosition(wheel, "counterclockwise")
+	if err != nil {
+		return err
+	}
+	if cw == 0 || ccw == 0 || (cw > 0) == (ccw > 0) {
+		return fmt.Errorf("unexpected wheel positions %v (clockwise) and %v (counterclockwise)", cw, ccw)
+	}
+
+	max := abs(cw)
+	if abs(ccw) > max {
+		max = abs(ccw)
+	}
+	step := 127 / int(max)
+
+	viper.Set("WheelMax", max)
+	viper.Set("WheelReverse", cw < 0)
+	viper.Set("Mappings."+mapping.ControlWheelUp+".Step", step)
+	viper.Set("Mappings."+mapping.ControlWheelDown+".Step", step)
+	if _, err := saveConfig(); err != nil {
+		return err
+	}
+
+	dlgs.Info(applicationName, fmt.Sprintf("Wheel calibrated.\nMaximum position: %v\nReversed: %v\nStep: %v", max, cw < 0, step))
+	return nil
+}
+
+// abs returns the absolute value of v
+func abs(v int8) int8 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
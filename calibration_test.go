@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dg1psi/shuttlemidi/devices"
+)
+
+func TestTrackWheel(t *testing.T) {
+	se := devices.NewVirtualShuttlExpress()
+
+	// the Mapper stopped before the calibration leaves its subscription behind
+	stopped := make(chan struct{})
+	se.Subscribe(stopped)
+	close(stopped)
+
+	quitch := make(chan struct{})
+	defer close(quitch)
+	wheel := trackWheel(se, quitch)
+	for _, position := range []int{1, 4, 7, -7} {
+		done := make(chan struct{})
+		go func() {
+			se.Simulate(devices.Wheel, position)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("reader blocked at wheel position %v", position)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for wheel() != -7 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if p := wheel(); p != -7 {
+		t.Errorf("tracked wheel position is %v, expected -7", p)
+	}
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dg1psi/shuttlemidi/devices"
+	"github.com/dg1psi/shuttlemidi/mapping"
+	"github.com/spf13/viper"
+)
+
+var (
+	// configDefaults contain the default configuration written to the configuration file
+	configDefaults = map[string]interface{}{
+		"MidiDevice":           "ShuttleMIDI",
+		"MidiExactMatch":       false,
+		"MidiFallback":         "",
+		"MidiFallbackDefault":  false,
+		"MidiChannel":          1,
+		"MidiMaxRate":          0,
+		"MidiSkipDuplicates":   false,
+		"WheelRampStep":        0,
+		"ControllerOffset":     0,
+		"ControllerRange":      map[string]interface{}{"Min": 0, "Max": 0},
+		"WheelIdleTimeout":     "0s",
+		"WheelReturnTimeout":   "0s",
+		"WheelMax":             7,
+		"WheelReverse":         false,
+		"WheelCenterWindow":    0,
+		"WheelPositiveInvert":  true,
+		"WheelNegativeInvert":  false,
+		"WheelFineThreshold":   0,
+		"WheelStopValue":       -1,
+		"WheelStepRate":        0,
+		"WheelBands":           []interface{}{},
+		"WheelStopActive":      false,
+		"DialRepeatWindow":     "0s",
+		"DialFilter":           0,
+		"DialResume":           false,
+		"GestureHoldTime":      "500ms",
+		"GestureDoubleTapTime": "300ms",
+		"GestureChordWindow":   "100ms",
+		"StartupDelay":         "0s",
+		"StartupRetries":       0,
+		"QuitConfirm":          false,
+		"SelfTest":             false,
+		"LogHIDReports":        false,
+		"TrayIcon":             "",
+		"SelfTestTimeout":      "10s",
+		"Mappings":             mappingDefaults,
+		"Preset":               "",
+		"PresetSwitch":         map[string]interface{}{"MidiDevice": "", "Rules": []interface{}{}},
+		"Learn":                map[string]interface{}{"MidiDevice": "", "Timeout": "10s"},
+		"MidiLogDir":           "",
+		"ChannelToggle":        map[string]interface{}{"Button": "", "Channels": []int{1, 2}},
+		"PanicButton":          "",
+		"HIDInterface":         map[string]interface{}{"UsagePage": 0, "Usage": 0, "Interface": -1},
+		"PersistState":         false,
+		"ClockButton":          "",
+		"DeviceCycle":          map[string]interface{}{"Button": "", "Devices": []string{}},
+		"Backends":             map[string]interface{}{},
+		"Pipelines":            map[string]interface{}{},
+		"API":                  map[string]interface{}{"Enabled": false, "Address": "127.0.0.1:8765", "Token": "", "Stream": false},
+	}
+)
+
+// Config contains the complete application configuration. It is populated once from the settings engine Viper by
+// loadConfig
+type Config struct {
+	// MidiDevice is the name of the MIDI output device
+	MidiDevice string
+	// MidiExactMatch only selects the MIDI device with exactly the name MidiDevice
+	MidiExactMatch bool
+	// MidiFallback is the name of the MIDI device used if MidiDevice is not available
+	MidiFallback string
+	// MidiFallbackDefault uses the default MIDI device of the system if neither MidiDevice nor MidiFallback is available
+	MidiFallbackDefault bool
+	// MidiChannel is the MIDI channel (1-16) used for all messages
+	MidiChannel uint8
+	// MidiMaxRate limits the number of MIDI messages sent per second. 0 disables the limit
+	MidiMaxRate int
+	// MidiSkipDuplicates doesn't send a controller value again, which was already sent last for the same controller
+	MidiSkipDuplicates bool
+	// WheelRampStep is the maximum change of the wheel value per repeated message. 0 disables ramping
+	WheelRampStep uint8
+	// ControllerOffset is added to all controller numbers sent out
+	ControllerOffset int
+	// ControllerRange contains the controller numbers the host listens on. Mappings outside of it are reported when the
+	// configuration is loaded
+	ControllerRange ControllerRangeConfig
+	// WheelIdleTimeout stops the wheel if no wheel event is received for the given duration. 0 disables the timeout
+	WheelIdleTimeout time.Duration
+	// WheelReturnTimeout stops the wheel if it leaves full deflection towards center and doesn't move on within the
+	// given duration, e.g. 30ms. 0 disables it
+	WheelReturnTimeout time.Duration
+	// WheelMax is the wheel position reported at full deflection
+	WheelMax int8
+	// WheelReverse swaps the direction of the wheel
+	WheelReverse bool
+	// WheelCenterWindow treats all wheel positions up to the given distance from the center as center position
+	WheelCenterWindow int8
+	// WheelPositiveInvert inverts the values of positive wheel positions to work around a bug in SDR Console with Tune Up
+	WheelPositiveInvert bool
+	// WheelNegativeInvert inverts the values of negative wheel positions, for hosts with the same bug for Tune Down
+	WheelNegativeInvert bool
+	// WheelFineThreshold is the maximum wheel position using the WheelUpFine and WheelDownFine mappings. 0 disables them
+	WheelFineThreshold int8
+	// WheelBands split the wheel positions into bands with their own Up and Down mappings, e.g. to step the channel with
+	// small deflections and the frequency with larger ones
+	WheelBands []mapping.WheelBand
+	// WheelStepRate enables the accumulator mode of the wheel, sending discrete WheelUp and WheelDown commands at the
+	// given number of steps per second and wheel position. 0 sends values proportional to the position instead
+	WheelStepRate float64
+	// WheelStopValue is the controller value sent when the wheel returns to center. -1 only stops the repeated
+	// messages without sending a value
+	WheelStopValue int
+	// WheelStopActive only sends WheelStopValue to the tune mapping which was active before the wheel returned to center.
+	// The other tune mappings only stop repeating
+	WheelStopActive bool
+	// DialRepeatWindow repeats the dial command while the dial keeps moving in one direction with less than the given
+	// duration between two detents. 0 disables repeating
+	DialRepeatWindow time.Duration
+	// DialFilter suppresses dial jitter by requiring the given number of consecutive detents after a direction reversal.
+	// 0 disables the filter
+	DialFilter int
+	// DialResume sends the dial detents of the first report after the ShuttlExpress was reconnected. By default the
+	// first report only sets the reference position of the dial
+	DialResume bool
+	// GestureHoldTime is the time a button has to be held to send its Hold mapping
+	GestureHoldTime time.Duration
+	// GestureDoubleTapTime is the maximum time between the presses of a DoubleTap. The Tap mappings are sent after it
+	GestureDoubleTapTime time.Duration
+	// GestureChordWindow is the maximum time between the first and the last press of the buttons of a Chord
+	GestureChordWindow time.Duration
+	// StartupDelay is the time to wait before the devices are opened on startup
+	StartupDelay time.Duration
+	// StartupRetries is the number of times opening the devices on startup is retried, with an increasing delay
+	StartupRetries int
+	// QuitConfirm asks for confirmation before the application is quit from the tray menu
+	QuitConfirm bool
+	// SelfTest checks on startup that the ShuttlExpress sends reports and the MIDI device can be written to
+	SelfTest bool
+	// LogHIDReports logs the raw bytes of every HID report of the ShuttlExpress for debugging
+	LogHIDReports bool
+	// TrayIcon is the path of an icon file replacing the embedded tray icon
+	TrayIcon string
+	// SelfTestTimeout is the time the self-test waits for a report of the ShuttlExpress
+	SelfTestTimeout time.Duration
+	// Mappings contains the mapping of each control, using the control identifiers as key
+	Mappings map[string]mapping.Mapping
+	// Preset is the name of the preset applied last. It is cleared when mappings are imported
+	Preset string
+	// PresetSwitch selects presets by the program change or control change messages the host sends to a MIDI input
+	PresetSwitch PresetSwitchConfig
+	// Learn is the MIDI input the learn mode of the tray menu receives the controllers assigned by the host from
+	Learn LearnConfig
+	// MidiLogDir is the directory the MIDI messages are logged to, in a separate file per preset. Empty disables it
+	MidiLogDir string
+	// ChannelToggle configures a button which toggles the MIDI channel
+	ChannelToggle ChannelToggleConfig
+	// PersistState saves the channel selected by the ChannelToggle and the values of the counter buttons to state.json
+	// next to the configuration file and restores them on startup
+	PersistState bool
+	// ClockButton is the identifier of the button (e.g. Button4) setting the tempo of the MIDI Clock by tapping. Holding
+	// it for GestureHoldTime stops the clock
+	ClockButton string
+	// HIDInterface selects the HID interface of the ShuttlExpress opened, if the HID stack reports several. A UsagePage
+	// or Usage of 0 and a negative Interface match any value
+	HIDInterface devices.DeviceFilter
+	// PanicButton is the identifier of the button (e.g. Button5) stopping all commands and sending All Controllers Off
+	// and All Notes Off, instead of its mapping. An empty string disables it
+	PanicButton string
+	// DeviceCycle configures a button which cycles through MIDI devices
+	DeviceCycle DeviceCycleConfig
+	// Backends contains additional output backends by name, which can be selected by the mappings
+	Backends map[string]BackendConfig
+	// Pipelines contains independent mappers by name, each handling a subset of the controls with its own mappings and
+	// backend instead of the main mappings
+	Pipelines map[string]PipelineConfig
+	// API contains the configuration of the local HTTP API
+	API APIConfig
+}
+
+// DeviceCycleConfig contains the configuration of the button cycling through MIDI devices
+type DeviceCycleConfig struct {
+	// Button is the identifier of the button (e.g. Button4) selecting the next MIDI device. An empty string disables it
+	Button string
+	// Devices contains the names of the MIDI devices to cycle through
+	Devices []string
+}
+
+// ControllerRangeConfig contains the range of the controller numbers accepted by the host. A Max of 0 disables the check
+type ControllerRangeConfig struct {
+	Min uint8
+	Max uint8
+}
+
+// ChannelToggleConfig contains the configuration of the button toggling between two MIDI channels
+type ChannelToggleConfig struct {
+	// Button is the identifier of the button (e.g. Button5) toggling the channel. An empty string disables toggling
+	Button string
+	// Channels contains the two MIDI channels (1-16) to toggle between
+	Channels []uint8
+}
+
+// firstRun is set by initSettings if the configuration file didn't exist and was created with the defaults
+var firstRun bool
+
+// configFormats contains the supported formats of the configuration file, identified by the file extension
+var configFormats = []string{"yaml", "json", "toml"}
+
+// validConfigFormat returns true if format is one of the configFormats
+func validConfigFormat(format string) bool {
+	for _, f := range configFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// initSettings initializes the settings engine Viper using the configuration file path. The format is detected from the
+// file extension. If path is empty, the configuration file in the user config directory is used and a config.yaml in
+// the working directory is migrated to it on the first run. If the file doesn't exist it is automatically created using
+// the defaults in the given format
+func initSettings(path string, format string) error {
+	for k, v := range configDefaults {
+		viper.SetDefault(k, v)
+	}
+
+	if path == "" {
+		var err error
+		if path, err = userConfigFile(format); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			path = "config.yaml"
+		} else if err := migrateConfig("config.yaml", path); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+	}
+	viper.SetConfigFile(path)
+
+	if err := viper.ReadInConfig(); err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println(err)
+			return err
+		}
+		firstRun = true
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			fmt.Println(err)
+		}
+		if err = viper.SafeWriteConfigAs(path); err != nil {
+			fmt.Println(err)
+			saveConfig()
+		}
+	}
+	return nil
+}
+
+// userConfigFile returns the path of the configuration file in the user config directory, e.g.
+// %APPDATA%\ShuttleMidi\config.yaml on Windows. An existing file in any of the configFormats is preferred, otherwise
+// the path of a file in the given format is returned
+func userConfigFile(format string) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "ShuttleMidi")
+	for _, f := range configFormats {
+		if path := filepath.Join(dir, "config."+f); fileExists(path) {
+			return path, nil
+		}
+	}
+	return filepath.Join(dir, "config."+format), nil
+}
+
+// fileExists returns true if the file at path exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// migrateConfig converts the configuration file from to the path to, if from exists and to doesn't. The format of
+// both files is detected from their extension
+func migrateConfig(from string, to string) error {
+	if fileExists(to) || !fileExists(from) {
+		return nil
+	}
+	v := viper.New()
+	v.SetConfigFile(from)
+	if err := v.ReadInConfig(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	if err := v.WriteConfigAs(to); err != nil {
+		return err
+	}
+	fmt.Printf("Configuration %v migrated to %v\n", from, to)
+	return nil
+}
+
+// saveConfig writes the configuration. If this fails, the configuration is written to userConfigFile, which is used
+// from then on. The path of the fallback file is returned if it was written
+func saveConfig() (string, error) {
+	err := viper.WriteConfig()
+	if err == nil {
+		return "", nil
+	}
+	fmt.Printf("Error: %v\n", err)
+
+	format := strings.TrimPrefix(filepath.Ext(viper.ConfigFileUsed()), ".")
+	if !validConfigFormat(format) {
+		format = "yaml"
+	}
+	path, ferr := userConfigFile(format)
+	if ferr != nil {
+		return "", err
+	}
+	if ferr := os.MkdirAll(filepath.Dir(path), 0755); ferr != nil {
+		return "", err
+	}
+	if ferr := viper.WriteConfigAs(path); ferr != nil {
+		return "", err
+	}
+	viper.SetConfigFile(path)
+	fmt.Printf("Configuration written to %v\n", path)
+	return path, nil
+}
+
+// loadConfig populates a Config from the settings engine Viper and validates it
+func loadConfig() (*Config, error) {
+	cfg := &Config{}
+	if err := viper.Unmarshal(cfg); err != nil {
+		return nil, err
+	}
+
+	cfg.Mappings, _ = mapping.NormalizeMappings(cfg.Mappings)
+	for name, p := range cfg.Pipelines {
+		p.Mappings, _ = mapping.NormalizeMappings(p.Mappings)
+		cfg.Pipelines[name] = p
+	}
+	if c, ok := mapping.ControlID(cfg.ChannelToggle.Button); ok {
+		cfg.ChannelToggle.Button = c
+	}
+	if c, ok := mapping.ControlID(cfg.DeviceCycle.Button); ok {
+		cfg.DeviceCycle.Button = c
+	}
+	if c, ok := mapping.ControlID(cfg.PanicButton); ok {
+		cfg.PanicButton = c
+	}
+	if c, ok := mapping.ControlID(cfg.ClockButton); ok {
+		cfg.ClockButton = c
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// config is the active configuration. It is read by the tray menu, the API and the mappers from different goroutines,
+// so it is replaced as a whole and never changed in place
+var (
+	config   *Config
+	configMu sync.RWMutex
+)
+
+// currentConfig returns the active configuration. The returned Config must not be changed
+func currentConfig() *Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return config
+}
+
+// setConfig makes cfg the active configuration
+func setConfig(cfg *Config) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	config = cfg
+}
+
+// updateConfig replaces the active configuration by the one returned by update, which is called with the active
+// configuration and must return a new Config instead of changing it. The new configuration is returned
+func updateConfig(update func(cur *Config) *Config) *Config {
+	configMu.Lock()
+	defer configMu.Unlock()
+	config = update(config)
+	return config
+}
+
+// reloadConfig loads the configuration and makes it the active one, keeping the selected MIDI device. The active
+// configuration is kept if the loaded one is invalid
+func reloadConfig() (*Config, error) {
+	var err error
+	cfg := updateConfig(func(cur *Config) *Config {
+		var newcfg *Config
+		if newcfg, err = loadConfig(); err != nil {
+			return cur
+		}
+		newcfg.MidiDevice = cur.MidiDevice
+		return newcfg
+	})
+	return cfg, err
+}
+
+// withMidiDevice returns a copy of cfg using the MIDI device name
+func (cfg *Config) withMidiDevice(name string) *Config {
+	c := *cfg
+	c.MidiDevice = name
+	return &c
+}
+
+// validate checks the configuration for values outside of the valid ranges
+func (cfg *Config) validate() error {
+	if cfg.MidiDevice == "" {
+		return errors.New("MidiDevice must not be empty")
+	}
+	if cfg.MidiChannel < 1 || cfg.MidiChannel > 16 {
+		return fmt.Errorf("MidiChannel %v is outside of the range 1 to 16", cfg.MidiChannel)
+	}
+	if cfg.MidiMaxRate < 0 {
+		return errors.New("MidiMaxRate must not be negative")
+	}
+	if cfg.ChannelToggle.Button != "" {
+		if _, ok := cfg.Mappings[cfg.ChannelToggle.Button]; !ok {
+			return fmt.Errorf("unknown ChannelToggle.Button %v", cfg.ChannelToggle.Button)
+		}
+		if len(cfg.ChannelToggle.Channels) != 2 {
+			return errors.New("ChannelToggle.Channels must contain two channels")
+		}
+		for _, ch := range cfg.ChannelToggle.Channels {
+			if ch < 1 || ch > 16 {
+				return fmt.Errorf("ChannelToggle channel %v is outside of the range 1 to 16", ch)
+			}
+		}
+	}
+	if cfg.PanicButton != "" {
+		if _, ok := cfg.Mappings[cfg.PanicButton]; !ok || !strings.HasPrefix(cfg.PanicButton, "Button") {
+			return fmt.Errorf("unknown PanicButton %v", cfg.PanicButton)
+		}
+		if cfg.PanicButton == cfg.ChannelToggle.Button || cfg.PanicButton == cfg.DeviceCycle.Button {
+			return errors.New("PanicButton must differ from ChannelToggle.Button and DeviceCycle.Button")
+		}
+	}
+	if cfg.ClockButton != "" {
+		if _, ok := cfg.Mappings[cfg.ClockButton]; !ok || !strings.HasPrefix(cfg.ClockButton, "Button") {
+			return fmt.Errorf("unknown ClockButton %v", cfg.ClockButton)
+		}
+		if cfg.ClockButton == cfg.ChannelToggle.Button || cfg.ClockButton == cfg.DeviceCycle.Button || cfg.ClockButton == cfg.PanicButton {
+			return errors.New("ClockButton must differ from ChannelToggle.Button, DeviceCycle.Button and PanicButton")
+		}
+	}
+	if cfg.DeviceCycle.Button != "" {
+		if _, ok := cfg.Mappings[cfg.DeviceCycle.Button]; !ok {
+			return fmt.Errorf("unknown DeviceCycle.Button %v", cfg.DeviceCycle.Button)
+		}
+		if cfg.DeviceCycle.Button == cfg.ChannelToggle.Button {
+			return errors.New("DeviceCycle.Button and ChannelToggle.Button must differ")
+		}
+		if len(cfg.DeviceCycle.Devices) < 2 {
+			return errors.New("DeviceCycle.Devices must contain at least two devices")
+		}
+	}
+	if cfg.ControllerOffset < -127 || cfg.ControllerOffset > 127 {
+		return fmt.Errorf("ControllerOffset %v is outside of the range -127 to 127", cfg.ControllerOffset)
+	}
+	if r := cfg.ControllerRange; r.Max > 127 || (r.Max > 0 && r.Min > r.Max) {
+		return fmt.Errorf("ControllerRange %v to %v is invalid", r.Min, r.Max)
+	}
+	if cfg.WheelIdleTimeout < 0 {
+		return errors.New("WheelIdleTimeout must not be negative")
+	}
+	if cfg.WheelReturnTimeout < 0 {
+		return errors.New("WheelReturnTimeout must not be negative")
+	}
+	if cfg.WheelMax < 1 || cfg.WheelMax > 7 {
+		return fmt.Errorf("WheelMax %v is outside of the range 1 to 7", cfg.WheelMax)
+	}
+	if cfg.WheelCenterWindow < 0 || cfg.WheelCenterWindow >= cfg.WheelMax {
+		return fmt.Errorf("WheelCenterWindow %v is outside of the range 0 to %v", cfg.WheelCenterWindow, cfg.WheelMax-1)
+	}
+	if cfg.WheelFineThreshold < 0 || cfg.WheelFineThreshold >= cfg.WheelMax {
+		return fmt.Errorf("WheelFineThreshold %v is outside of the range 0 to %v", cfg.WheelFineThreshold, cfg.WheelMax-1)
+	}
+	for i, b := range cfg.WheelBands {
+		if b.Max < 1 || b.Max > cfg.WheelMax || (i > 0 && b.Max <= cfg.WheelBands[i-1].Max) {
+			return fmt.Errorf("Max %v of WheelBands entry %v must be between 1 and %v and above the previous band", b.Max, i+1, cfg.WheelMax)
+		}
+		if err := b.Up.Validate(fmt.Sprintf("WheelBand%vUp", i+1)); err != nil {
+			return err
+		}
+		if err := b.Down.Validate(fmt.Sprintf("WheelBand%vDown", i+1)); err != nil {
+			return err
+		}
+	}
+	if cfg.WheelStepRate < 0 {
+		return errors.New("WheelStepRate must not be negative")
+	}
+	if cfg.WheelStopValue < -1 || cfg.WheelStopValue > 127 {
+		return fmt.Errorf("WheelStopValue %v is outside of the range -1 to 127", cfg.WheelStopValue)
+	}
+	if cfg.DialFilter < 0 {
+		return errors.New("DialFilter must not be negative")
+	}
+	if cfg.DialRepeatWindow < 0 {
+		return errors.New("DialRepeatWindow must not be negative")
+	}
+	if cfg.GestureHoldTime <= 0 || cfg.GestureDoubleTapTime <= 0 || cfg.GestureChordWindow <= 0 {
+		return errors.New("GestureHoldTime, GestureDoubleTapTime and GestureChordWindow must be positive")
+	}
+	if cfg.SelfTest && cfg.SelfTestTimeout <= 0 {
+		return errors.New("SelfTestTimeout must be positive")
+	}
+	if cfg.StartupDelay < 0 || cfg.StartupRetries < 0 {
+		return errors.New("StartupDelay and StartupRetries must not be negative")
+	}
+	if err := cfg.API.validate(); err != nil {
+		return err
+	}
+	if err := cfg.PresetSwitch.validate(); err != nil {
+		return err
+	}
+	if cfg.Learn.MidiDevice != "" && cfg.Learn.Timeout <= 0 {
+		return errors.New("Timeout of Learn must be positive")
+	}
+	for _, c := range mapping.Controls {
+		if _, ok := cfg.Mappings[c]; !ok {
+			return fmt.Errorf("no mapping configured for %v", c)
+		}
+	}
+	// the optional mappings are dispatched like the mappings of the controls and are checked the same way
+	for c, m := range cfg.Mappings {
+		if err := m.Validate(c); err != nil {
+			return err
+		}
+	}
+	for name, b := range cfg.Backends {
+		if b.URL != "" {
+			if _, err := devices.NewController(b.URL); err != nil {
+				return fmt.Errorf("invalid URL of backend %v: %v", name, err)
+			}
+			continue
+		}
+		if b.MidiChannel < 1 || b.MidiChannel > 16 {
+			return fmt.Errorf("MidiChannel %v of backend %v is outside of the range 1 to 16", b.MidiChannel, name)
+		}
+	}
+	claimed := make(map[devices.Control]string)
+	for name, p := range cfg.Pipelines {
+		if err := p.validate(name, cfg, claimed); err != nil {
+			return err
+		}
+	}
+	for c, m := range cfg.Mappings {
+		if err := cfg.validateBackendNames(m, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateBackendNames checks that the Backend and Also of the mapping described by name are configured backends
+func (cfg *Config) validateBackendNames(m mapping.Mapping, name string) error {
+	for _, b := range append([]string{m.Backend}, m.Also...) {
+		if _, ok := cfg.Backends[strings.ToLower(b)]; b != "" && !ok {
+			return fmt.Errorf("unknown backend %v of mapping %v", b, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dg1psi/shuttlemidi/mapping"
+	"github.com/spf13/viper"
+)
+
+func TestMigrateConfig(t *testing.T) {
+	for _, format := range configFormats {
+		t.Run(format, func(t *testing.T) {
+			dir := t.TempDir()
+			from := filepath.Join(dir, "config.yaml")
+			to := filepath.Join(dir, "user", "config."+format)
+			if err := os.WriteFile(from, []byte("MidiDevice: loopMIDI Port\nMidiChannel: 3\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := migrateConfig(from, to); err != nil {
+				t.Fatal(err)
+			}
+
+			v := viper.New()
+			v.SetConfigFile(to)
+			if err := v.ReadInConfig(); err != nil {
+				t.Fatalf("migrated configuration can't be read: %v", err)
+			}
+			if v.GetString("MidiDevice") != "loopMIDI Port" || v.GetInt("MidiChannel") != 3 {
+				t.Errorf("migrated configuration contains %v", v.AllSettings())
+			}
+		})
+	}
+}
+
+// resetSettings resets Viper and firstRun before and after the test
+func resetSettings(t *testing.T) {
+	viper.Reset()
+	firstRun = false
+	t.Cleanup(func() {
+		viper.Reset()
+		firstRun = false
+	})
+}
+
+func TestInitSettingsDefaults(t *testing.T) {
+	for _, format := range configFormats {
+		t.Run(format, func(t *testing.T) {
+			resetSettings(t)
+			path := filepath.Join(t.TempDir(), "ShuttleMidi", "config."+format)
+			if err := initSettings(path, format); err != nil {
+				t.Fatal(err)
+			}
+			if !firstRun {
+				t.Error("firstRun not set for a new configuration")
+			}
+
+			v := viper.New()
+			v.SetConfigFile(path)
+			if err := v.ReadInConfig(); err != nil {
+				t.Fatalf("written configuration can't be read: %v", err)
+			}
+			if v.GetString("MidiDevice") != configDefaults["MidiDevice"] || v.GetInt("MidiChannel") != configDefaults["MidiChannel"] {
+				t.Errorf("written configuration contains %v", v.AllSettings())
+			}
+			if !v.IsSet("Mappings.WheelUp.Controller") {
+				t.Error("default mappings not written")
+			}
+		})
+	}
+}
+
+func TestInitSettingsExisting(t *testing.T) {
+	resetSettings(t)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := []byte("MidiDevice: Thetis Port\nMidiChannel: 5\n")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := initSettings(path, "yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if firstRun {
+		t.Error("firstRun set for an existing configuration")
+	}
+	if viper.GetString("MidiDevice") != "Thetis Port" || viper.GetInt("MidiChannel") != 5 {
+		t.Errorf("configuration read as %v", viper.AllSettings())
+	}
+	// settings missing in the file use the defaults
+	if viper.GetInt("WheelMax") != configDefaults["WheelMax"] {
+		t.Errorf("WheelMax is %v", viper.GetInt("WheelMax"))
+	}
+	if data, _ := os.ReadFile(path); string(data) != string(content) {
+		t.Errorf("configuration changed to %q", data)
+	}
+}
+
+func TestInitSettingsMalformed(t *testing.T) {
+	resetSettings(t)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := []byte("MidiDevice: [Thetis Port\nMidiChannel: 5\n")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := initSettings(path, "yaml"); err == nil {
+		t.Error("no error for a malformed configuration")
+	}
+	if firstRun {
+		t.Error("firstRun set for a malformed configuration")
+	}
+	if data, _ := os.ReadFile(path); string(data) != string(content) {
+		t.Errorf("malformed configuration overwritten with %q", data)
+	}
+}
+
+func TestBackendChannel(t *testing.T) {
+	for _, tt := range []struct {
+		backend  BackendConfig
+		expected uint8
+	}{
+		{BackendConfig{MidiDevice: "loopMIDI", MidiChannel: 3}, 3},
+		{BackendConfig{URL: "midi://loopMIDI Port?channel=5"}, 5},
+		{BackendConfig{URL: "osc://127.0.0.1:9000/midi"}, 1},
+		{BackendConfig{URL: "osc://127.0.0.1:9000?channel=17", MidiChannel: 4}, 1},
+	} {
+		if c := tt.backend.channel(); c != tt.expected {
+			t.Errorf("channel of %+v is %v, expected %v", tt.backend, c, tt.expected)
+		}
+	}
+}
+
+func TestValidateOptionalMappings(t *testing.T) {
+	resetSettings(t)
+	if err := initSettings(filepath.Join(t.TempDir(), "config.yaml"), "yaml"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		control string
+		mapping mapping.Mapping
+	}{
+		{mapping.ControlDialButton1, mapping.Mapping{SpeedTime: time.Second}},
+		{mapping.ControlDialButton2, mapping.Mapping{Type: "pitch"}},
+		{mapping.ControlWheelUpMax, mapping.Mapping{Type: mapping.TypeNote}},
+		{mapping.ControlBank, mapping.Mapping{Channel: 17}},
+		{"Button3Hold", mapping.Mapping{SendMode: "sometimes"}},
+	} {
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Mappings[tt.control] = tt.mapping
+		if err := cfg.validate(); err == nil {
+			t.Errorf("invalid mapping %v passed validation", tt.control)
+		}
+	}
+}
+
+func TestUpdateConfig(t *testing.T) {
+	old := &Config{MidiDevice: "first", Preset: "SDR#"}
+	setConfig(old)
+	defer setConfig(nil)
+
+	cfg := updateConfig(func(cur *Config) *Config { return cur.withMidiDevice("second") })
+	if cfg == old || currentConfig() != cfg {
+		t.Fatal("the active configuration wasn't replaced")
+	}
+	if old.MidiDevice != "first" {
+		t.Errorf("previous configuration changed to %v", old.MidiDevice)
+	}
+	if cfg.MidiDevice != "second" || cfg.Preset != "SDR#" {
+		t.Errorf("unexpected configuration %+v", cfg)
+	}
+}
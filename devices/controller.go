@@ -0,0 +1,99 @@
+package devices
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrUnsupportedScheme = errors.New("unsupported controller scheme")
+
+// NewController creates a MidiController from a URL like spec. The scheme selects the backend, "midi" for a MIDI device
+// or "osc" for an OSC host receiving the MIDI messages over UDP:
+//
+//	midi://<device>?channel=1&delay=100ms&exact=true&offset=0&ramp=0&maxrate=0
+//	osc://<host>:<port>/<address>?channel=1&delay=100ms&offset=0&ramp=0&maxrate=0
+//
+// The device name has to be URL encoded. The OSC messages are sent to the address pattern (default /midi) with the MIDI
+// message as single argument of the type "m". channel is the MIDI channel (1-16, default 1), the remaining parameters
+// correspond to the fields of MidiOptions. The controller isn't opened
+func NewController(spec string) (MidiController, error) {
+	return NewControllerWithOptions(spec, MidiOptions{})
+}
+
+// NewControllerWithOptions works like NewController, but starts with the given options, which are overridden by the
+// parameters of the URL. It sets the options which can't be expressed by a URL, like OnStall and Log
+func NewControllerWithOptions(spec string, options MidiOptions) (MidiController, error) {
+	// an escaped device name isn't a valid host, so it is parsed as opaque part
+	if strings.HasPrefix(spec, "midi://") {
+		spec = "midi:" + strings.TrimPrefix(spec, "midi://")
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "midi":
+		return newMIDIControllerFromURL(u, options)
+	case "osc":
+		return newOSCControllerFromURL(u, options)
+	}
+	return nil, fmt.Errorf("%w: %v", ErrUnsupportedScheme, u.Scheme)
+}
+
+// newMIDIControllerFromURL creates a MidiController for a midi:// URL
+func newMIDIControllerFromURL(u *url.URL, options MidiOptions) (MidiController, error) {
+	device, err := url.PathUnescape(u.Opaque)
+	if err != nil {
+		return nil, err
+	}
+	if device == "" {
+		return nil, errors.New("no MIDI device specified in " + u.String())
+	}
+	channel, delay, options, err := controllerQuery(u, options)
+	if err != nil {
+		return nil, err
+	}
+	return NewMIDIController(nil, device, delay, channel-1, options), nil
+}
+
+// controllerQuery returns the channel (1-16), the repeat delay and options with the fields set by the query parameters
+// of the URL replaced
+func controllerQuery(u *url.URL, options MidiOptions) (uint8, time.Duration, MidiOptions, error) {
+	q := u.Query()
+	channel, delay := uint8(1), 100*time.Millisecond
+	var err error
+	for key := range q {
+		value := q.Get(key)
+		switch key {
+		case "channel":
+			var c int
+			if c, err = strconv.Atoi(value); err == nil && (c < 1 || c > 16) {
+				err = fmt.Errorf("channel %v is outside of the range 1 to 16", c)
+			}
+			channel = uint8(c)
+		case "delay":
+			delay, err = time.ParseDuration(value)
+		case "exact":
+			options.ExactMatch, err = strconv.ParseBool(value)
+		case "offset":
+			options.Offset, err = strconv.Atoi(value)
+		case "ramp":
+			var r uint64
+			r, err = strconv.ParseUint(value, 10, 8)
+			options.RampStep = uint8(r)
+		case "maxrate":
+			options.MaxRate, err = strconv.Atoi(value)
+		default:
+			err = errors.New("unknown parameter")
+		}
+		if err != nil {
+			return 0, 0, options, fmt.Errorf("parameter %v of %v: %w", key, u.String(), err)
+		}
+	}
+	return channel, delay, options, nil
+}
@@ -0,0 +1,39 @@
+package devices
+
+import "testing"
+
+func TestNewControllerSchemes(t *testing.T) {
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{"midi://loopMIDI%20Port?channel=2", true},
+		{"osc://127.0.0.1:9000", true},
+		{"osc://127.0.0.1:9000/midi?maxrate=50", true},
+		{"osc://127.0.0.1", false},
+		{"osc://127.0.0.1:9000?channel=17", false},
+		{"keyboard://", false},
+	}
+	for _, tt := range tests {
+		if _, err := NewController(tt.spec); (err == nil) != tt.ok {
+			t.Errorf("%v: %v", tt.spec, err)
+		}
+	}
+
+	mc, _ := NewController("midi://loopMIDI%20Port?channel=2")
+	if name := mc.(*midiControl).DeviceName; name != "loopMIDI Port" {
+		t.Errorf("device name %q", name)
+	}
+}
+
+func TestNewControllerWithOptions(t *testing.T) {
+	stalled := func() {}
+	mc, err := NewControllerWithOptions("midi://loopMIDI?offset=5", MidiOptions{Offset: 2, MaxRate: 50, SkipDuplicates: true, OnStall: stalled})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := mc.(*midiControl).MidiOptions
+	if o.Offset != 5 || o.MaxRate != 50 || !o.SkipDuplicates || o.OnStall == nil {
+		t.Errorf("options %+v, expected the offset of the URL and the remaining options passed", o)
+	}
+}
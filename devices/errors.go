@@ -0,0 +1,35 @@
+package devices
+
+import "fmt"
+
+// DeviceError describes a failed operation on a ShuttlExpress or MIDI device. Kind is the sentinel error of the failure
+// mode, e.g. ErrMIDIDeviceNotFound, which is matched by errors.Is. Err contains the error reported by the driver and is
+// returned by Unwrap, so errors.As finds the driver specific error as well
+type DeviceError struct {
+	Device string // name or path of the device, may be empty
+	Op     string // operation which failed, e.g. "open" or "write"
+	Kind   error
+	Err    error
+}
+
+// Error returns the failure mode followed by the device and the error of the driver, if available
+func (e *DeviceError) Error() string {
+	msg := e.Kind.Error()
+	if e.Device != "" {
+		msg = fmt.Sprintf("%v: %v %v", msg, e.Op, e.Device)
+	}
+	if e.Err != nil {
+		msg = fmt.Sprintf("%v (%v)", msg, e.Err)
+	}
+	return msg
+}
+
+// Is reports whether target is the failure mode of the error
+func (e *DeviceError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Unwrap returns the error reported by the driver
+func (e *DeviceError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,62 @@
+package devices
+
+import (
+	"fmt"
+	"time"
+)
+
+// Control identifies a single ShuttlExpress hardware control
+type Control uint8
+
+const (
+	Wheel Control = iota
+	Dial
+	Button1
+	Button2
+	Button3
+	Button4
+	Button5
+)
+
+// controlNames contains the names of all controls, used for the string and JSON representation
+var controlNames = []string{"Wheel", "Dial", "Button1", "Button2", "Button3", "Button4", "Button5"}
+
+// String returns the name of the control
+func (c Control) String() string {
+	if int(c) < len(controlNames) {
+		return controlNames[c]
+	}
+	return fmt.Sprintf("Control(%d)", uint8(c))
+}
+
+// MarshalText returns the name of the control. It is used for the JSON representation of events
+func (c Control) MarshalText() ([]byte, error) {
+	if int(c) >= len(controlNames) {
+		return nil, fmt.Errorf("unknown control %d", uint8(c))
+	}
+	return []byte(controlNames[c]), nil
+}
+
+// UnmarshalText sets the control from its name
+func (c *Control) UnmarshalText(text []byte) error {
+	for i, v := range controlNames {
+		if v == string(text) {
+			*c = Control(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown control %q", text)
+}
+
+// Event contains a single change of a ShuttlExpress control.
+// Value contains the wheel position (-7 to 7), the dial direction (-1 or 1) or the button state (1 pressed, 0 released)
+type Event struct {
+	Control Control   `json:"control"`
+	Value   int       `json:"value"`
+	Time    time.Time `json:"time"`
+}
+
+// String returns a human readable representation of the event used for logging
+func (e Event) String() string {
+	return fmt.Sprintf("%v %v: %v", e.Time.Format("15:04:05.000"), e.Control, e.Value)
+}
@@ -0,0 +1,287 @@
+package devices
+
+import (
+	"fmt"
+	"time"
+)
+
+// GestureType specifies the kind of a Gesture
+type GestureType uint8
+
+const (
+	Tap GestureType = iota
+	DoubleTap
+	Hold
+	Chord
+	WheelVelocity
+	WheelExtreme
+)
+
+// gestureNames contains the names of all gesture types
+var gestureNames = []string{"Tap", "DoubleTap", "Hold", "Chord", "WheelVelocity", "WheelExtreme"}
+
+// String returns the name of the gesture type
+func (t GestureType) String() string {
+	if int(t) < len(gestureNames) {
+		return gestureNames[t]
+	}
+	return fmt.Sprintf("GestureType(%d)", uint8(t))
+}
+
+// Gesture is a higher level event detected from the events of the ShuttlExpress controls
+type Gesture struct {
+	Type    GestureType
+	Control Control     // button of Tap, DoubleTap, Hold and WheelExtreme
+	Buttons ButtonState // buttons of a Chord
+	Value   int         // wheel positions per second of WheelVelocity, direction (1 or -1) of WheelExtreme
+	Time    time.Time
+}
+
+// String returns a human readable representation of the gesture used for logging
+func (g Gesture) String() string {
+	switch g.Type {
+	case Chord:
+		return fmt.Sprintf("%v %v: %05b", g.Time.Format("15:04:05.000"), g.Type, uint8(g.Buttons))
+	case WheelVelocity, WheelExtreme:
+		return fmt.Sprintf("%v %v: %v", g.Time.Format("15:04:05.000"), g.Type, g.Value)
+	}
+	return fmt.Sprintf("%v %v %v", g.Time.Format("15:04:05.000"), g.Control, g.Type)
+}
+
+// GestureOptions contains the timing of the gesture detection
+type GestureOptions struct {
+	// HoldTime is the time a button has to be pressed to be detected as Hold
+	HoldTime time.Duration
+	// DoubleTapTime is the maximum time between two taps of a DoubleTap. A Tap is reported after this time
+	DoubleTapTime time.Duration
+	// ChordWindow is the maximum time between the first and the last press of the buttons of a Chord. The Chord is
+	// reported once it elapsed
+	ChordWindow time.Duration
+	// WheelMax is the wheel position of full deflection reported as WheelExtreme while a button is held. 0 disables it
+	WheelMax int
+}
+
+// buttonstate contains the gesture state of a single button
+type buttonstate struct {
+	pressed    bool
+	pressedAt  time.Time
+	holdSent   bool
+	consumed   bool // the press was part of a chord
+	tapPending bool
+	releasedAt time.Time
+}
+
+// GestureDetector consumes the events of a ShuttlExpress and sends the detected gestures through Gestures.
+// Buttons pressed together within ChordWindow are reported as one Chord when the window closes and don't create any
+// other gesture. A button held for HoldTime is
+// reported as Hold, two short presses within DoubleTapTime as DoubleTap and a single short press as Tap after
+// DoubleTapTime. Every wheel event is reported as WheelVelocity. The wheel reaching full deflection while a button is
+// held, or a button pressed while the wheel is at full deflection, is reported once as WheelExtreme. The button doesn't
+// create any other gesture then
+type GestureDetector struct {
+	Gestures chan Gesture
+	GestureOptions
+
+	events       <-chan Event
+	quitch       chan struct{}
+	buttons      [5]buttonstate
+	chordStart   time.Time
+	chordButtons ButtonState // buttons of the Chord reported when ChordWindow closes
+	chordSent    bool
+	wheelValue   int
+	wheelTime    time.Time
+	extreme      bool // WheelExtreme was sent for the current full deflection
+}
+
+// checkExtreme sends the WheelExtreme gesture for the first pressed button, if the wheel is at full deflection
+func (gd *GestureDetector) checkExtreme(t time.Time) {
+	if gd.WheelMax <= 0 || gd.extreme {
+		return
+	}
+	direction := 0
+	if gd.wheelValue >= gd.WheelMax {
+		direction = 1
+	} else if gd.wheelValue <= -gd.WheelMax {
+		direction = -1
+	}
+	if direction == 0 {
+		return
+	}
+	for i := range gd.buttons {
+		if b := &gd.buttons[i]; b.pressed && !b.consumed {
+			b.consumed, b.tapPending = true, false
+			gd.extreme = true
+			gd.emit(Gesture{Type: WheelExtreme, Control: Button1 + Control(i), Value: direction, Time: t})
+			return
+		}
+	}
+}
+
+// emit sends the gesture, unless the detector is stopped
+func (gd *GestureDetector) emit(g Gesture) {
+	select {
+	case gd.Gestures <- g:
+	case <-gd.quitch:
+	}
+}
+
+// pressedButtons returns the state of all buttons currently pressed
+func (gd *GestureDetector) pressedButtons() ButtonState {
+	var bs ButtonState
+	for i, b := range gd.buttons {
+		if b.pressed {
+			bs |= 1 << i
+		}
+	}
+	return bs
+}
+
+// handleButton updates the state of the button and sends DoubleTap gestures. The buttons of a Chord are collected
+// until handleTimeouts sends it
+func (gd *GestureDetector) handleButton(e Event) {
+	i := int(e.Control - Button1)
+	b := &gd.buttons[i]
+	if e.Value != 0 {
+		if gd.pressedButtons() == 0 {
+			// the buttons of the previous chord were released before its window closed
+			gd.sendChord(e.Time)
+			gd.chordStart, gd.chordSent = e.Time, false
+		}
+		*b = buttonstate{pressed: true, pressedAt: e.Time, tapPending: b.tapPending, releasedAt: b.releasedAt}
+		if pressed := gd.pressedButtons(); pressed&^(1<<i) != 0 && !gd.chordSent && e.Time.Sub(gd.chordStart) <= gd.ChordWindow {
+			// further buttons pressed within the window join the chord
+			gd.chordButtons |= pressed
+			for j := range gd.buttons {
+				if pressed&(1<<j) != 0 {
+					gd.buttons[j].consumed = true
+					gd.buttons[j].tapPending = false
+				}
+			}
+		}
+		gd.checkExtreme(e.Time)
+		return
+	}
+
+	b.pressed = false
+	if b.consumed || b.holdSent {
+		return
+	}
+	if b.tapPending && e.Time.Sub(b.releasedAt) <= gd.DoubleTapTime {
+		b.tapPending = false
+		gd.emit(Gesture{Type: DoubleTap, Control: e.Control, Time: e.Time})
+		return
+	}
+	b.tapPending, b.releasedAt = true, e.Time
+}
+
+// sendChord sends the Chord of the buttons pressed within ChordWindow, if there is one
+func (gd *GestureDetector) sendChord(t time.Time) {
+	if gd.chordButtons == 0 {
+		return
+	}
+	buttons := gd.chordButtons
+	gd.chordButtons, gd.chordSent = 0, true
+	gd.emit(Gesture{Type: Chord, Buttons: buttons, Time: t})
+}
+
+// handleWheel sends the WheelVelocity gesture for the wheel event
+func (gd *GestureDetector) handleWheel(e Event) {
+	velocity := 0
+	if !gd.wheelTime.IsZero() {
+		if d := e.Time.Sub(gd.wheelTime).Seconds(); d > 0 {
+			delta := e.Value - gd.wheelValue
+			if delta < 0 {
+				delta = -delta
+			}
+			velocity = int(float64(delta) / d)
+		}
+	}
+	gd.wheelValue, gd.wheelTime = e.Value, e.Time
+	gd.emit(Gesture{Type: WheelVelocity, Control: Wheel, Value: velocity, Time: e.Time})
+
+	if e.Value > -gd.WheelMax && e.Value < gd.WheelMax {
+		gd.extreme = false
+	}
+	gd.checkExtreme(e.Time)
+}
+
+// handleTimeouts sends the Chord, Hold and Tap gestures which are due and returns the time of the next timeout
+func (gd *GestureDetector) handleTimeouts(now time.Time) time.Time {
+	var next time.Time
+	schedule := func(t time.Time) {
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	if gd.chordButtons != 0 {
+		if due := gd.chordStart.Add(gd.ChordWindow); !now.Before(due) {
+			gd.sendChord(now)
+		} else {
+			schedule(due)
+		}
+	}
+	for i := range gd.buttons {
+		b := &gd.buttons[i]
+		if b.pressed && !b.holdSent && !b.consumed {
+			if due := b.pressedAt.Add(gd.HoldTime); !now.Before(due) {
+				b.holdSent, b.tapPending = true, false
+				gd.emit(Gesture{Type: Hold, Control: Button1 + Control(i), Time: now})
+			} else {
+				schedule(due)
+			}
+		}
+		if b.tapPending && !b.pressed {
+			if due := b.releasedAt.Add(gd.DoubleTapTime); !now.Before(due) {
+				b.tapPending = false
+				gd.emit(Gesture{Type: Tap, Control: Button1 + Control(i), Time: now})
+			} else {
+				schedule(due)
+			}
+		}
+	}
+	return next
+}
+
+// run is the goroutine detecting the gestures
+func (gd *GestureDetector) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-gd.quitch:
+			return
+		case e := <-gd.events:
+			switch {
+			case e.Control == Wheel:
+				gd.handleWheel(e)
+			case e.Control >= Button1 && e.Control <= Button5:
+				gd.handleButton(e)
+			}
+		case <-timer.C:
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if next := gd.handleTimeouts(time.Now()); !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+// Stop stops the gesture detection
+func (gd *GestureDetector) Stop() {
+	close(gd.quitch)
+}
+
+// NewGestureDetector creates a GestureDetector reading the events from events, usually the Events channel of a
+// ShuttlExpress, and starts the detection
+func NewGestureDetector(events <-chan Event, options GestureOptions) *GestureDetector {
+	gd := &GestureDetector{Gestures: make(chan Gesture), GestureOptions: options, events: events, quitch: make(chan struct{})}
+	go gd.run()
+	return gd
+}
@@ -0,0 +1,165 @@
+package devices
+
+import (
+	"testing"
+	"time"
+)
+
+// gestureOptions is the timing used by the gesture tests. The events are at least 10ms apart from the edges of the
+// windows, so the tests don't depend on the exact scheduling of the goroutines
+var gestureOptions = GestureOptions{
+	HoldTime:      100 * time.Millisecond,
+	DoubleTapTime: 50 * time.Millisecond,
+	ChordWindow:   30 * time.Millisecond,
+	WheelMax:      7,
+}
+
+// timedEvent is an event sent to the detector after the offset to the start of the test
+type timedEvent struct {
+	offset  time.Duration
+	control Control
+	value   int
+}
+
+// detectGestures sends the events to a new detector at their offsets and returns the gestures detected until 200ms
+// after the last event. WheelVelocity is skipped, as it is sent for every wheel event
+func detectGestures(events []timedEvent) []Gesture {
+	eventch := make(chan Event)
+	gd := NewGestureDetector(eventch, gestureOptions)
+	defer gd.Stop()
+
+	start := time.Now()
+	go func() {
+		for _, e := range events {
+			time.Sleep(time.Until(start.Add(e.offset)))
+			eventch <- Event{Control: e.control, Value: e.value, Time: start.Add(e.offset)}
+		}
+	}()
+
+	var gestures []Gesture
+	timeout := time.After(events[len(events)-1].offset + 200*time.Millisecond)
+	for {
+		select {
+		case g := <-gd.Gestures:
+			if g.Type != WheelVelocity {
+				gestures = append(gestures, g)
+			}
+		case <-timeout:
+			return gestures
+		}
+	}
+}
+
+func TestGestureDetector(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name     string
+		events   []timedEvent
+		expected []Gesture
+	}{
+		{
+			"tap",
+			[]timedEvent{{0, Button1, 1}, {10 * ms, Button1, 0}},
+			[]Gesture{{Type: Tap, Control: Button1}},
+		},
+		{
+			"double tap",
+			[]timedEvent{{0, Button2, 1}, {10 * ms, Button2, 0}, {20 * ms, Button2, 1}, {30 * ms, Button2, 0}},
+			[]Gesture{{Type: DoubleTap, Control: Button2}},
+		},
+		{
+			"two taps outside the double tap time",
+			[]timedEvent{{0, Button2, 1}, {10 * ms, Button2, 0}, {100 * ms, Button2, 1}, {110 * ms, Button2, 0}},
+			[]Gesture{{Type: Tap, Control: Button2}, {Type: Tap, Control: Button2}},
+		},
+		{
+			"hold",
+			[]timedEvent{{0, Button3, 1}, {150 * ms, Button3, 0}},
+			[]Gesture{{Type: Hold, Control: Button3}},
+		},
+		{
+			"release before the hold time",
+			[]timedEvent{{0, Button3, 1}, {80 * ms, Button3, 0}},
+			[]Gesture{{Type: Tap, Control: Button3}},
+		},
+		{
+			"chord",
+			[]timedEvent{{0, Button1, 1}, {10 * ms, Button2, 1}, {40 * ms, Button1, 0}, {50 * ms, Button2, 0}},
+			[]Gesture{{Type: Chord, Buttons: 0b00011}},
+		},
+		{
+			"held chord",
+			[]timedEvent{{0, Button4, 1}, {20 * ms, Button5, 1}, {150 * ms, Button4, 0}, {150 * ms, Button5, 0}},
+			[]Gesture{{Type: Chord, Buttons: 0b11000}},
+		},
+		{
+			"three button chord",
+			[]timedEvent{{0, Button2, 1}, {0, Button4, 1}, {0, Button5, 1}, {60 * ms, Button2, 0}, {60 * ms, Button4, 0}, {60 * ms, Button5, 0}},
+			[]Gesture{{Type: Chord, Buttons: 0b11010}},
+		},
+		{
+			"third button joining within the chord window",
+			[]timedEvent{{0, Button1, 1}, {10 * ms, Button3, 1}, {20 * ms, Button5, 1}, {60 * ms, Button1, 0}, {60 * ms, Button3, 0}, {60 * ms, Button5, 0}},
+			[]Gesture{{Type: Chord, Buttons: 0b10101}},
+		},
+		{
+			"second press outside the chord window",
+			[]timedEvent{{0, Button1, 1}, {50 * ms, Button2, 1}, {60 * ms, Button1, 0}, {70 * ms, Button2, 0}},
+			[]Gesture{{Type: Tap, Control: Button1}, {Type: Tap, Control: Button2}},
+		},
+		{
+			"wheel extreme while a button is held",
+			[]timedEvent{{0, Button1, 1}, {10 * ms, Wheel, 3}, {20 * ms, Wheel, 7}, {30 * ms, Wheel, 0}, {40 * ms, Button1, 0}},
+			[]Gesture{{Type: WheelExtreme, Control: Button1, Value: 1}},
+		},
+		{
+			"button pressed with the wheel at the extreme",
+			[]timedEvent{{0, Wheel, -7}, {10 * ms, Button2, 1}, {20 * ms, Button2, 0}, {30 * ms, Wheel, 0}},
+			[]Gesture{{Type: WheelExtreme, Control: Button2, Value: -1}},
+		},
+		{
+			"wheel extreme sent once",
+			[]timedEvent{{0, Button1, 1}, {10 * ms, Wheel, 7}, {20 * ms, Wheel, 7}, {60 * ms, Button2, 1}, {70 * ms, Button2, 0}, {80 * ms, Button1, 0}},
+			[]Gesture{{Type: WheelExtreme, Control: Button1, Value: 1}, {Type: Tap, Control: Button2}},
+		},
+		{
+			"wheel below the extreme",
+			[]timedEvent{{0, Button1, 1}, {10 * ms, Wheel, 6}, {20 * ms, Button1, 0}, {30 * ms, Wheel, 0}},
+			[]Gesture{{Type: Tap, Control: Button1}},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			gestures := detectGestures(tt.events)
+			if len(gestures) != len(tt.expected) {
+				t.Fatalf("detected %v, expected %v", gestures, tt.expected)
+			}
+			for i, g := range gestures {
+				e := tt.expected[i]
+				if g.Type != e.Type || g.Control != e.Control || g.Buttons != e.Buttons || g.Value != e.Value {
+					t.Errorf("gesture %v is %v, expected %v", i, g, e)
+				}
+			}
+		})
+	}
+}
+
+func TestGestureWheelVelocity(t *testing.T) {
+	eventch := make(chan Event)
+	gd := NewGestureDetector(eventch, gestureOptions)
+	defer gd.Stop()
+
+	start := time.Now()
+	for i, e := range []struct {
+		offset   time.Duration
+		value    int
+		velocity int
+	}{{0, 1, 0}, {100 * time.Millisecond, 3, 20}, {600 * time.Millisecond, -2, 10}} {
+		go func(e Event) { eventch <- e }(Event{Control: Wheel, Value: e.value, Time: start.Add(e.offset)})
+		if g := <-gd.Gestures; g.Type != WheelVelocity || g.Value != e.velocity {
+			t.Errorf("gesture %v is %v, expected %v: %v", i, g, WheelVelocity, e.velocity)
+		}
+	}
+}
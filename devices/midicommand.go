@@ -0,0 +1,104 @@
+package devices
+
+import (
+	"fmt"
+	"time"
+)
+
+// MessageType specifies the kind of MIDI message sent by a Command
+type MessageType uint8
+
+const (
+	ControlChange MessageType = iota
+	NoteOn
+	NoteOff
+	ProgramChange
+	PitchBend
+)
+
+// String returns the name of the message type
+func (t MessageType) String() string {
+	switch t {
+	case ControlChange:
+		return "ControlChange"
+	case NoteOn:
+		return "NoteOn"
+	case NoteOff:
+		return "NoteOff"
+	case ProgramChange:
+		return "ProgramChange"
+	case PitchBend:
+		return "PitchBend"
+	}
+	return fmt.Sprintf("MessageType(%d)", uint8(t))
+}
+
+// MarshalText returns the name of the message type
+func (t MessageType) MarshalText() ([]byte, error) {
+	if t > PitchBend {
+		return nil, fmt.Errorf("unknown message type %d", uint8(t))
+	}
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText sets the message type from its name
+func (t *MessageType) UnmarshalText(text []byte) error {
+	for v := ControlChange; v <= PitchBend; v++ {
+		if v.String() == string(text) {
+			*t = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown message type %q", text)
+}
+
+// StopValue is a controller value outside of the valid MIDI range of 0-127. A ControlChange command with this value
+// doesn't send any message, but stops a repeating command for the same controller
+const StopValue uint8 = 255
+
+// Command contains a single MIDI message that will be send out by a MidiController
+type Command struct {
+	Name    string // friendly name of the mapping the command belongs to, used for logging
+	Type    MessageType
+	Channel uint8 // MIDI channel 1-16. 0 uses the channel of the MidiController
+	Data1   uint8 // controller number, note number or program number
+	Data2   uint8 // controller value or note velocity. Controller values above 127, like StopValue, are not sent
+	Bend    int16 // pitch bend value between -8192 and 8191
+	Repeat  bool
+	Delay   time.Duration // delay between repeated messages. 0 uses the delay of the MidiController
+	// Continuous repeats the command until it is replaced, instead of at most midiMaxRepeat times
+	Continuous bool
+	// TickStep is added to the controller value of each repeated ControlChange message, clamped to 0-127
+	TickStep int8
+}
+
+// commandKey identifies the target of a Command. A new command for the same target replaces a repeating one
+type commandKey struct {
+	msgtype MessageType
+	channel uint8
+	data1   uint8
+}
+
+// key returns the commandKey of the command
+func (cmd *Command) key() commandKey {
+	return commandKey{msgtype: cmd.Type, channel: cmd.Channel, data1: cmd.Data1}
+}
+
+// String returns a human readable representation of the command used for logging
+func (cmd Command) String() string {
+	var msg string
+	switch cmd.Type {
+	case ProgramChange:
+		msg = fmt.Sprintf("%v, Channel: %v, Program: %v", cmd.Type, cmd.Channel, cmd.Data1)
+	case PitchBend:
+		msg = fmt.Sprintf("%v, Channel: %v, Value: %v, Repeat: %v", cmd.Type, cmd.Channel, cmd.Bend, cmd.Repeat)
+	case NoteOn, NoteOff:
+		msg = fmt.Sprintf("%v, Channel: %v, Note: %v, Velocity: %v", cmd.Type, cmd.Channel, cmd.Data1, cmd.Data2)
+	default:
+		msg = fmt.Sprintf("%v, Channel: %v, Controller: %v, Value: %v, Repeat: %v", cmd.Type, cmd.Channel, cmd.Data1, cmd.Data2, cmd.Repeat)
+	}
+	if cmd.Name != "" {
+		return cmd.Name + ": " + msg
+	}
+	return msg
+}
@@ -2,8 +2,11 @@ package devices
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"gitlab.com/gomidi/midi"
@@ -13,11 +16,22 @@ import (
 
 const (
 	midiMaxRepeat = 50 // maximum number a message is repeated
+
+	midiAllControllersOff = 121 // controller number of the All Controllers Off channel mode message
+	midiAllNotesOff       = 123 // controller number of the All Notes Off channel mode message
+
+	midiClockPPQN = 24 // number of MIDI Clock messages per quarter note
+
+	midiWriteTimeout = 500 * time.Millisecond // maximum duration of a single write before the device is considered stalled
 )
 
 var (
 	ErrMIDIDeviceNotFound       = errors.New("MIDI Device not found")
 	ErrMIDIDeviceNotInitialized = errors.New("MIDI Device not initialized")
+	ErrMIDIDeviceBusy           = errors.New("MIDI Device is in use by another application or can't be opened")
+	ErrMIDIDriverInit           = errors.New("MIDI driver not available")
+	ErrMIDIWriteFailed          = errors.New("MIDI message couldn't be written")
+	ErrMIDIWriteTimeout         = errors.New("MIDI Device doesn't respond")
 )
 
 // MidiController is the public interface to send out MIDI controller messages to a device
@@ -25,114 +39,470 @@ type MidiController interface {
 	Open() error
 	Close() error
 	SendCommand(controller uint8, value uint8, repeat bool) error
+	Send(cmd Command) error
+	SetChannel(channel uint8) error
+	Port() string
+	Dropped() uint64
+	Repeats() []RepeatState
+	Test() error
+	Panic() error
+	SetClock(bpm float64) error
+}
+
+// RepeatState contains a command which is currently repeated and the number of remaining repetitions
+type RepeatState struct {
+	Command   Command
+	Remaining int
 }
 
-// midiControllerCommand contains a single command that will be send out
-type midiControllerCommand struct {
-	controller uint8
-	value      uint8
-	repeat     bool
+// MidiOptions contains the optional settings of a MidiController
+type MidiOptions struct {
+	// RampStep specifies the maximum change of a repeated controller value per message. 0 disables ramping
+	RampStep uint8
+	// Offset is added to the controller number of all ControlChange commands. The result is clamped to 0-127
+	Offset int
+	// ExactMatch only selects a MIDI device if its name equals the device name. Otherwise a device containing the
+	// device name is selected, if there is no exact match
+	ExactMatch bool
+	// FallbackDevice is the name of the MIDI device used if no device matches the device name
+	FallbackDevice string
+	// FallbackDefault selects the default MIDI device of the system if neither the device name nor FallbackDevice match
+	FallbackDefault bool
+	// MaxRate limits the number of messages sent per second. Excess messages are delayed and replaced by newer messages
+	// for the same target. 0 disables the limit
+	MaxRate int
+	// SkipDuplicates doesn't send a ControlChange command with the value sent last for the same controller. Repeated
+	// messages of a repeating command are still sent
+	SkipDuplicates bool
+	// OnStall is called in a new goroutine once a write didn't complete within midiWriteTimeout, e.g. because the port
+	// was deleted. All further writes fail until the controller is reopened, which OnStall usually does. It may be nil
+	OnStall func()
+	// Log receives a line with a timestamp for every message sent, in addition to the standard logger. nil disables it
+	Log io.Writer
 }
 
 // midiControl contains all driver and channel variables in required for the communication
 type midiControl struct {
+	dropped uint64 // number of messages dropped because of MaxRate, accessed atomically. Kept first for alignment
+
 	DeviceName string
 	Delay      time.Duration
 	Channel    uint8
-	drv        midi.Driver
-	output     midi.Out
-	wr         *writer.Writer
+	MidiOptions
+	drv    midi.Driver
+	output midi.Out
+	wr     *writer.Writer
+	// stalled is set by writeTimed after a timeout. It is only accessed by the goroutine commandExecutor, like writeTimer
+	stalled    bool
+	writeTimer *time.Timer
+	// writech passes the writes to writeLoop, which returns their result through writtench
+	writech   chan func() error
+	writtench chan error
 
-	commandch chan *midiControllerCommand
+	commandch chan *Command
+	channelch chan uint8
+	statusch  chan chan []RepeatState
+	testch    chan chan error
+	panicch   chan chan error
+	clockch   chan float64
 	quitch    chan struct{}
+	donech    chan struct{}
+}
+
+// rampValue moves value towards target by at most step and returns the result
+func rampValue(value uint8, target uint8, step uint8) uint8 {
+	if value < target {
+		if target-value > step {
+			return value + step
+		}
+	} else if value > target {
+		if value-target > step {
+			return value - step
+		}
+	}
+	return target
+}
+
+// tickValue adds step to value and clamps the result to the valid controller range of 0-127
+func tickValue(value uint8, step int8) uint8 {
+	v := int(value) + int(step)
+	if v < 0 {
+		return 0
+	} else if v > 127 {
+		return 127
+	}
+	return uint8(v)
+}
+
+// offsetController adds offset to the controller number and clamps the result to the valid range of 0-127
+func offsetController(controller uint8, offset int) uint8 {
+	c := int(controller) + offset
+	if c < 0 {
+		return 0
+	} else if c > 127 {
+		return 127
+	}
+	return uint8(c)
+}
+
+// write sends a single command to the MIDI device. A failure is returned as DeviceError of the kind ErrMIDIWriteFailed
+// or ErrMIDIWriteTimeout, see writeTimed
+func (mc *midiControl) write(cmd *Command) error {
+	c := *cmd
+	return mc.writeTimed(func() error { return mc.writeMessage(&c) })
+}
+
+// writeTimed passes the write to the goroutine writeLoop and waits for its result. The driver may block on a deleted
+// port, so if the write doesn't complete within midiWriteTimeout, the controller is stalled and ErrMIDIWriteTimeout is
+// returned. All further writes fail immediately, as writeLoop may still be blocked
+func (mc *midiControl) writeTimed(write func() error) error {
+	if mc.stalled {
+		return &DeviceError{Device: mc.Port(), Op: "write", Kind: ErrMIDIWriteTimeout}
+	}
+
+	mc.writech <- write
+	mc.writeTimer.Reset(midiWriteTimeout)
+	select {
+	case err := <-mc.writtench:
+		if !mc.writeTimer.Stop() {
+			<-mc.writeTimer.C
+		}
+		if err != nil {
+			return &DeviceError{Device: mc.Port(), Op: "write", Kind: ErrMIDIWriteFailed, Err: err}
+		}
+		return nil
+	case <-mc.writeTimer.C:
+		mc.stalled = true
+		if mc.OnStall != nil {
+			go mc.OnStall()
+		}
+		return &DeviceError{Device: mc.Port(), Op: "write", Kind: ErrMIDIWriteTimeout}
+	}
+}
+
+// writeLoop is the goroutine executing the writes of writeTimed, so a blocking driver doesn't block commandExecutor. It
+// is stopped by closing writech
+func (mc *midiControl) writeLoop() {
+	for write := range mc.writech {
+		mc.writtench <- write()
+	}
+}
+
+// writeMessage writes the MIDI message of the command using the writer. Channels above 16 are rejected, as the writer
+// would send a different message or panic
+func (mc *midiControl) writeMessage(cmd *Command) error {
+	if cmd.Channel > 16 {
+		return fmt.Errorf("channel %v is outside of the range 1 to 16", cmd.Channel)
+	}
+	if cmd.Channel > 0 {
+		mc.wr.SetChannel(cmd.Channel - 1)
+		defer mc.wr.SetChannel(mc.Channel)
+	}
+
+	switch cmd.Type {
+	case ControlChange:
+		if cmd.Data2 > 127 {
+			return nil
+		}
+		return writer.ControlChange(mc.wr, cmd.Data1, cmd.Data2)
+	case NoteOn:
+		return writer.NoteOn(mc.wr, cmd.Data1, cmd.Data2)
+	case NoteOff:
+		return writer.NoteOff(mc.wr, cmd.Data1)
+	case ProgramChange:
+		return writer.ProgramChange(mc.wr, cmd.Data1)
+	case PitchBend:
+		return writer.Pitchbend(mc.wr, cmd.Bend)
+	}
+	return nil
+}
+
+// logf logs a sent message and writes it to Log, if set
+func (mc *midiControl) logf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+	if mc.Log != nil {
+		fmt.Fprintf(mc.Log, time.Now().Format("2006/01/02 15:04:05.000 ")+format, v...)
+	}
+}
+
+// repeatDelay returns the delay between two repetitions of the command
+func (mc *midiControl) repeatDelay(cmd *Command) time.Duration {
+	if cmd.Delay > 0 {
+		return cmd.Delay
+	}
+	return mc.Delay
 }
 
 // commandExecutor sends out MIDI messages received through the commandch channel. It also takes care of sending messages out
-// repeatedly, in case it is requested
+// repeatedly, in case it is requested. Every repeated command is scheduled with its own delay. If RampStep is set, repeated
+// controller values are ramped towards the requested value by at most RampStep per tick instead of jumping to it instantly
 func (mc *midiControl) commandExecutor() {
-	type tickstruct struct {
+	type repeatstate struct {
+		cmd     Command
 		counter int
-		value   uint8
+		target  uint8
+		due     time.Time
+	}
+	repeatcmd := make(map[commandKey]*repeatstate)
+	lastvalue := make(map[commandKey]uint8)
+
+	// pending contains the commands delayed by MaxRate, nextwrite is the earliest time the next message may be sent
+	pending := make(map[commandKey]Command)
+	var nextwrite time.Time
+	var interval time.Duration
+	if mc.MaxRate > 0 {
+		interval = time.Second / time.Duration(mc.MaxRate)
+	}
+
+	// send writes the command or delays it, if MaxRate is exceeded. A delayed command replaces an older delayed command
+	// for the same target, which is counted as dropped
+	send := func(cmd *Command) {
+		now := time.Now()
+		if interval > 0 && now.Before(nextwrite) {
+			if _, ok := pending[cmd.key()]; ok {
+				atomic.AddUint64(&mc.dropped, 1)
+			}
+			pending[cmd.key()] = *cmd
+			return
+		}
+		if err := mc.write(cmd); err != nil {
+			log.Println(err)
+		}
+		nextwrite = now.Add(interval)
+	}
+	// flush writes a delayed command, if MaxRate allows it
+	flush := func() {
+		now := time.Now()
+		for k, cmd := range pending {
+			if now.Before(nextwrite) {
+				return
+			}
+			if err := mc.write(&cmd); err != nil {
+				log.Println(err)
+			}
+			delete(pending, k)
+			nextwrite = now.Add(interval)
+		}
 	}
-	repeatcmd := make(map[uint8]tickstruct)
-	tick := time.NewTicker(mc.Delay)
-	defer tick.Stop()
 
-	tick.Stop()
+	timer := time.NewTimer(mc.Delay)
+	defer timer.Stop()
+	timer.Stop()
+
+	// clock sends the MIDI Clock messages while the clock is running, clockticks is nil otherwise
+	var clock *time.Ticker
+	var clockticks <-chan time.Time
+	stopClock := func() {
+		if clock != nil {
+			clock.Stop()
+			clock, clockticks = nil, nil
+			log.Println("Clock: Stop")
+			mc.writeTimed(func() error { return writer.RTStop(mc.wr) })
+		}
+	}
+
+	// schedule sets the timer to the next due repetition or delayed command
+	schedule := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		var next time.Time
+		for _, r := range repeatcmd {
+			if next.IsZero() || r.due.Before(next) {
+				next = r.due
+			}
+		}
+		if len(pending) > 0 && (next.IsZero() || nextwrite.Before(next)) {
+			next = nextwrite
+		}
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+	}
+
+	defer close(mc.donech)
 
 	for {
 		select {
 		case <-mc.quitch:
+			// stop all repeated and delayed commands, so nothing is sent after Close
+			stopClock()
+			for k := range repeatcmd {
+				delete(repeatcmd, k)
+			}
+			for k := range pending {
+				delete(pending, k)
+			}
 			return
+		case reply := <-mc.testch:
+			// Active Sensing is ignored by receivers not using it
+			reply <- mc.writeTimed(func() error {
+				_, err := mc.output.Write([]byte{0xFE})
+				return err
+			})
+		case reply := <-mc.panicch:
+			for k := range repeatcmd {
+				delete(repeatcmd, k)
+			}
+			for k := range pending {
+				delete(pending, k)
+			}
+			stopClock()
+			log.Println("Panic: All Controllers Off, All Notes Off")
+			var err error
+			for ch := uint8(1); ch <= 16; ch++ {
+				for _, c := range []uint8{midiAllControllersOff, midiAllNotesOff} {
+					if werr := mc.write(&Command{Type: ControlChange, Channel: ch, Data1: c}); werr != nil && err == nil {
+						err = werr
+					}
+				}
+			}
+			reply <- err
+			schedule()
+		case reply := <-mc.statusch:
+			repeats := make([]RepeatState, 0, len(repeatcmd))
+			for _, r := range repeatcmd {
+				repeats = append(repeats, RepeatState{Command: r.cmd, Remaining: r.counter})
+			}
+			reply <- repeats
+		case bpm := <-mc.clockch:
+			if bpm <= 0 {
+				stopClock()
+				break
+			}
+			interval := time.Duration(float64(time.Minute) / (bpm * midiClockPPQN))
+			if clock == nil {
+				log.Printf("Clock: Start, %.1f BPM\n", bpm)
+				mc.writeTimed(func() error { return writer.RTStart(mc.wr) })
+				clock = time.NewTicker(interval)
+				clockticks = clock.C
+			} else {
+				log.Printf("Clock: %.1f BPM\n", bpm)
+				clock.Reset(interval)
+			}
+		case <-clockticks:
+			mc.writeTimed(func() error { return writer.RTClock(mc.wr) })
+		case ch := <-mc.channelch:
+			log.Printf("Channel: %v\n", ch)
+			mc.Channel = ch
+			mc.wr.SetChannel(ch)
 		case cmd := <-mc.commandch:
-			log.Printf("Controller: %v, Value: %v, Repeat: %v\n", cmd.controller, cmd.value, cmd.repeat)
-			if cmd.value <= 127 {
-				writer.ControlChange(mc.wr, cmd.controller, cmd.value)
+			key := cmd.key()
+			target := cmd.Data2
+			if last, ok := lastvalue[key]; ok && cmd.Repeat && cmd.Type == ControlChange && mc.RampStep > 0 && target <= 127 {
+				cmd.Data2 = rampValue(last, target, mc.RampStep)
 			}
-			if cmd.repeat {
-				repeatcmd[cmd.controller] = tickstruct{counter: midiMaxRepeat, value: cmd.value}
-				tick.Reset(mc.Delay)
+			if last, ok := lastvalue[key]; ok && mc.SkipDuplicates && cmd.Type == ControlChange && cmd.Data2 == last {
+				// only the repetition of a repeating command is scheduled
+				log.Printf("%v, skipped duplicate\n", cmd)
 			} else {
-				delete(repeatcmd, cmd.controller)
-				if len(repeatcmd) == 0 {
-					tick.Stop()
-				}
+				mc.logf("%v\n", cmd)
+				send(cmd)
+			}
+			if cmd.Type == ControlChange && cmd.Data2 <= 127 {
+				lastvalue[key] = cmd.Data2
+			}
+			if cmd.Repeat {
+				repeatcmd[key] = &repeatstate{cmd: *cmd, counter: midiMaxRepeat, target: target, due: time.Now().Add(mc.repeatDelay(cmd))}
+			} else {
+				delete(repeatcmd, key)
 			}
-		case <-tick.C:
-			for k, v := range repeatcmd {
-				if v.counter > 1 {
-					log.Printf("Controller: %v, Value: %v, Repeat-Counter: %v\n", k, v.value, v.counter)
-					writer.ControlChange(mc.wr, k, v.value)
-					v.counter--
-					repeatcmd[k] = v
+			schedule()
+		case <-timer.C:
+			flush()
+			now := time.Now()
+			for k, r := range repeatcmd {
+				if r.due.After(now) {
+					continue
+				}
+				if r.counter > 1 || r.cmd.Continuous {
+					if r.cmd.Type == ControlChange && r.cmd.TickStep != 0 && r.cmd.Data2 <= 127 {
+						// the stepped value becomes the new target, so ramping doesn't move it back
+						r.cmd.Data2 = tickValue(r.cmd.Data2, r.cmd.TickStep)
+						r.target = r.cmd.Data2
+						lastvalue[k] = r.cmd.Data2
+					} else if r.cmd.Type == ControlChange && mc.RampStep > 0 {
+						r.cmd.Data2 = rampValue(r.cmd.Data2, r.target, mc.RampStep)
+						lastvalue[k] = r.cmd.Data2
+					}
+					mc.logf("%v, Repeat-Counter: %v\n", r.cmd, r.counter)
+					send(&r.cmd)
+					if !r.cmd.Continuous {
+						r.counter--
+					}
+					r.due = now.Add(mc.repeatDelay(&r.cmd))
 				} else {
 					delete(repeatcmd, k)
 				}
 			}
-			if len(repeatcmd) == 0 {
-				tick.Stop()
-			}
+			schedule()
 		}
 	}
 }
 
 // Open connects to the driver specified during instance creation, sets the channel used for the MIDI messages and starts
-// the goroutine used for message sending
+// the goroutine used for message sending. Failures are returned as DeviceError of the kinds ErrMIDIDriverInit,
+// ErrMIDIDeviceNotFound and ErrMIDIDeviceBusy
 func (mc *midiControl) Open() error {
 
 	if mc.drv == nil {
 		drv, err := rtmididrv.New()
 		if err != nil {
-			log.Println(err)
+			return &DeviceError{Op: "open", Kind: ErrMIDIDriverInit, Err: err}
 		}
 		mc.drv = drv
 	}
 
 	outs, err := mc.drv.Outs()
 	if err != nil {
-		log.Println(err)
+		return &DeviceError{Op: "list", Kind: ErrMIDIDriverInit, Err: err}
 	}
+	names := make([]string, 0, len(outs))
 	for i, v := range outs {
 		log.Printf("%v: %v\n", i, v.String())
-		if strings.Contains(v.String(), mc.DeviceName) {
-			mc.output = outs[i]
-		}
+		names = append(names, v.String())
 	}
 
-	if mc.output == nil {
-		return ErrMIDIDeviceNotFound
+	i := MatchMIDIDevice(names, mc.DeviceName, mc.ExactMatch)
+	if i < 0 && mc.FallbackDevice != "" {
+		log.Printf("MIDI device %v not found, trying fallback device %v\n", mc.DeviceName, mc.FallbackDevice)
+		i = MatchMIDIDevice(names, mc.FallbackDevice, mc.ExactMatch)
+	}
+	if i < 0 && mc.FallbackDefault && len(outs) > 0 {
+		// the first output port is the default device of the system
+		log.Printf("MIDI device %v not found, using default device\n", mc.DeviceName)
+		i = 0
+	}
+	if i < 0 {
+		return &DeviceError{Device: mc.DeviceName, Op: "open", Kind: ErrMIDIDeviceNotFound}
 	}
+	log.Printf("Using MIDI device %v: %v\n", i, names[i])
 
-	if err := mc.output.Open(); err != nil {
-		log.Println(err)
+	if err := outs[i].Open(); err != nil {
+		return &DeviceError{Device: names[i], Op: "open", Kind: ErrMIDIDeviceBusy, Err: err}
 	}
+	mc.output = outs[i]
 
 	mc.wr = writer.New(mc.output)
 	mc.wr.SetChannel(mc.Channel)
 
-	mc.commandch = make(chan *midiControllerCommand, 1)
+	mc.commandch = make(chan *Command, 1)
+	mc.channelch = make(chan uint8)
+	mc.statusch = make(chan chan []RepeatState)
+	mc.testch = make(chan chan error)
+	mc.panicch = make(chan chan error)
+	mc.clockch = make(chan float64)
 	mc.quitch = make(chan struct{})
+	mc.donech = make(chan struct{})
+	mc.writech = make(chan func() error, 1)
+	mc.writtench = make(chan error, 1)
+	mc.writeTimer = time.NewTimer(midiWriteTimeout)
+	mc.writeTimer.Stop()
 
+	go mc.writeLoop()
 	go mc.commandExecutor()
 	return nil
 }
@@ -140,23 +510,140 @@ func (mc *midiControl) Open() error {
 // SendCommand sends a ControllerChange MIDI command to the current MIDI device. If repeat is true then the message
 // will be send up to midiMaxRepeat times with a delay as specified during instance creation
 func (mc *midiControl) SendCommand(controller uint8, value uint8, repeat bool) error {
+	return mc.Send(Command{Type: ControlChange, Data1: controller, Data2: value, Repeat: repeat})
+}
+
+// Send sends the given command to the current MIDI device. If cmd.Repeat is true then the message will be send up to
+// midiMaxRepeat times with a delay of cmd.Delay, or the delay specified during instance creation if cmd.Delay is 0
+func (mc *midiControl) Send(cmd Command) error {
 	if mc.output == nil {
 		return ErrMIDIDeviceNotInitialized
 	}
-	cmd := &midiControllerCommand{controller: controller, value: value, repeat: repeat}
-	mc.commandch <- cmd
+	if cmd.Type == ControlChange && mc.Offset != 0 {
+		cmd.Data1 = offsetController(cmd.Data1, mc.Offset)
+	}
+	select {
+	case mc.commandch <- &cmd:
+	case <-mc.quitch:
+		return ErrMIDIDeviceNotInitialized
+	}
 
 	return nil
 }
 
-// Close stops the goroutine and closes all channels and drivers
+// SetChannel changes the MIDI channel (0-15) used for all subsequent commands without an explicit channel
+func (mc *midiControl) SetChannel(channel uint8) error {
+	if mc.output == nil {
+		return ErrMIDIDeviceNotInitialized
+	}
+	select {
+	case mc.channelch <- channel:
+	case <-mc.quitch:
+		return ErrMIDIDeviceNotInitialized
+	}
+
+	return nil
+}
+
+// Port returns the name of the MIDI device in use. An empty string is returned if no device is opened
+func (mc *midiControl) Port() string {
+	if mc.output == nil {
+		return ""
+	}
+	return mc.output.String()
+}
+
+// Repeats returns all commands which are currently repeated. nil is returned if no device is opened
+func (mc *midiControl) Repeats() []RepeatState {
+	if mc.output == nil {
+		return nil
+	}
+	reply := make(chan []RepeatState, 1)
+	select {
+	case mc.statusch <- reply:
+		return <-reply
+	case <-mc.quitch:
+		return nil
+	}
+}
+
+// Test writes a single Active Sensing message to the MIDI device and returns the error of the write
+func (mc *midiControl) Test() error {
+	if mc.output == nil {
+		return ErrMIDIDeviceNotInitialized
+	}
+	reply := make(chan error, 1)
+	select {
+	case mc.testch <- reply:
+		return <-reply
+	case <-mc.quitch:
+		return ErrMIDIDeviceNotInitialized
+	}
+}
+
+// Panic discards all repeated and delayed commands and sends All Controllers Off and All Notes Off on all 16 channels.
+// The Offset isn't applied to these channel mode messages
+func (mc *midiControl) Panic() error {
+	if mc.output == nil {
+		return ErrMIDIDeviceNotInitialized
+	}
+	reply := make(chan error, 1)
+	select {
+	case mc.panicch <- reply:
+		return <-reply
+	case <-mc.quitch:
+		return ErrMIDIDeviceNotInitialized
+	}
+}
+
+// SetClock sends Start and MIDI Clock messages with 24 pulses per quarter note at the given tempo in beats per minute.
+// Calling it again while the clock is running changes the tempo. A tempo of 0 sends Stop and stops the clock
+func (mc *midiControl) SetClock(bpm float64) error {
+	if mc.output == nil {
+		return ErrMIDIDeviceNotInitialized
+	}
+	select {
+	case mc.clockch <- bpm:
+		return nil
+	case <-mc.quitch:
+		return ErrMIDIDeviceNotInitialized
+	}
+}
+
+// Dropped returns the number of messages dropped because MaxRate was exceeded
+func (mc *midiControl) Dropped() uint64 {
+	return atomic.LoadUint64(&mc.dropped)
+}
+
+// Close stops the goroutine, discards all queued and repeated commands and closes the driver. Commands sent afterwards
+// return ErrMIDIDeviceNotInitialized
 func (mc *midiControl) Close() error {
 	if mc.quitch != nil {
+		select {
+		case <-mc.quitch:
+			return nil // already closed
+		default:
+		}
 		close(mc.quitch)
+		<-mc.donech
+		close(mc.writech)
+		// drain a command queued before the goroutine stopped
+		select {
+		case <-mc.commandch:
+		default:
+		}
+	}
+	if dropped := mc.Dropped(); dropped > 0 {
+		log.Printf("%v: dropped %v messages because of MaxRate\n", mc.DeviceName, dropped)
 	}
 
-	errout := mc.output.Close()
-	errdrv := mc.drv.Close()
+	var errout, errdrv error
+	if mc.output != nil {
+		errout = mc.output.Close()
+	}
+	if mc.drv != nil {
+		errdrv = mc.drv.Close()
+	}
 
 	if errout != nil {
 		return errout
@@ -169,8 +656,36 @@ func (mc *midiControl) Close() error {
 // NewMIDIController creates a new MidiController instance with the specified parameters. If nil is passed as driver
 // the default driver will be used (rtmididrv).
 // delay specifies the time between each command message, in case the message should be send repeatedly.
-func NewMIDIController(driver midi.Driver, devicename string, delay time.Duration, channel uint8) MidiController {
-	return &midiControl{drv: driver, DeviceName: devicename, Delay: delay, Channel: channel}
+func NewMIDIController(driver midi.Driver, devicename string, delay time.Duration, channel uint8, options MidiOptions) MidiController {
+	return &midiControl{drv: driver, DeviceName: devicename, Delay: delay, Channel: channel, MidiOptions: options}
+}
+
+// MatchMIDIDevice returns the index of the device name matching name. An exact match is preferred over a device name
+// containing name. If exact is true, only exact matches are considered. -1 is returned if no device matches
+func MatchMIDIDevice(devices []string, name string, exact bool) int {
+	match := -1
+	for i, v := range devices {
+		if v == name {
+			return i
+		}
+		if !exact && match < 0 && strings.Contains(v, name) {
+			match = i
+		}
+	}
+	return match
+}
+
+// MatchMIDIKeywords returns the index of the first device name containing one of the keywords, ignoring the case.
+// Keywords are tried in the given order. -1 is returned if no device matches
+func MatchMIDIKeywords(devices []string, keywords []string) int {
+	for _, k := range keywords {
+		for i, v := range devices {
+			if strings.Contains(strings.ToLower(v), strings.ToLower(k)) {
+				return i
+			}
+		}
+	}
+	return -1
 }
 
 // GetMIDIDevices returns a list of all devices availalbe for the specified driver. If nil is passed as driver
@@ -0,0 +1,110 @@
+//go:build integration
+// +build integration
+
+package devices
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/gomidi/midi"
+	"gitlab.com/gomidi/midi/reader"
+	"gitlab.com/gomidi/rtmididrv"
+)
+
+// The integration test needs a loopback MIDI port, e.g. a loopMIDI port on Windows or the "Midi Through" port of ALSA
+// on Linux. The port is selected by SHUTTLEMIDI_LOOPBACK and defaults to "loopMIDI":
+//
+//	SHUTTLEMIDI_LOOPBACK="Midi Through" go test -tags integration ./devices/
+func loopbackPort() string {
+	if name := os.Getenv("SHUTTLEMIDI_LOOPBACK"); name != "" {
+		return name
+	}
+	return "loopMIDI"
+}
+
+func TestLoopback(t *testing.T) {
+	drv, err := rtmididrv.New()
+	if err != nil {
+		t.Skipf("MIDI driver not available: %v", err)
+	}
+
+	ins, err := drv.Ins()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(ins))
+	for i, in := range ins {
+		names[i] = in.String()
+	}
+	i := MatchMIDIDevice(names, loopbackPort(), false)
+	if i < 0 {
+		t.Skipf("loopback port %v not found in %v", loopbackPort(), names)
+	}
+	in := ins[i]
+	if err := in.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var received [][]byte
+	rd := reader.New(reader.NoLogger(), reader.Each(func(_ *reader.Position, msg midi.Message) {
+		mu.Lock()
+		received = append(received, msg.Raw())
+		mu.Unlock()
+	}))
+	if err := rd.ListenTo(in); err != nil {
+		t.Fatal(err)
+	}
+
+	// the controller closes the driver, so the input is stopped first
+	mc := NewMIDIController(drv, loopbackPort(), 10*time.Millisecond, 1, MidiOptions{})
+	if err := mc.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		in.StopListening()
+		in.Close()
+		mc.Close()
+	}()
+
+	// the messages must arrive in order and on the channel of the controller (2) or the command (10). The writer sends
+	// a NoteOff as NoteOn with velocity 0
+	commands := []Command{
+		{Type: ControlChange, Data1: 3, Data2: 127},
+		{Type: NoteOn, Channel: 10, Data1: 60, Data2: 100},
+		{Type: NoteOff, Channel: 10, Data1: 60},
+		{Type: ProgramChange, Data1: 5},
+		{Type: ControlChange, Data1: 3, Data2: 0},
+	}
+	expected := [][]byte{{0xB1, 3, 127}, {0x99, 60, 100}, {0x99, 60, 0}, {0xC1, 5}, {0xB1, 3, 0}}
+	for _, cmd := range commands {
+		if err := mc.Send(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(received)
+		mu.Unlock()
+		if n >= len(expected) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != len(expected) {
+		t.Fatalf("received % X, expected % X", received, expected)
+	}
+	for i := range expected {
+		if string(received[i]) != string(expected[i]) {
+			t.Errorf("message %v is % X, expected % X", i, received[i], expected[i])
+		}
+	}
+}
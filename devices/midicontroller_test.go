@@ -0,0 +1,325 @@
+package devices
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/gomidi/midi"
+	"gitlab.com/gomidi/midi/testdrv"
+)
+
+func TestMain(m *testing.M) {
+	// every message sent is logged, which would flood the test output
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// recorder collects the messages written to the output port of the test driver
+type recorder struct {
+	mu   sync.Mutex
+	msgs [][]byte
+}
+
+// listen is the listener of the input port of the test driver, which receives everything written to its output port
+func (r *recorder) listen(b []byte, _ int64) {
+	msg := append([]byte(nil), b...)
+	r.mu.Lock()
+	r.msgs = append(r.msgs, msg)
+	r.mu.Unlock()
+}
+
+// messages returns a copy of the messages received so far
+func (r *recorder) messages() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]byte(nil), r.msgs...)
+}
+
+// openTestController opens a controller writing to the test driver. The controller is closed when the test ends
+func openTestController(tb testing.TB, delay time.Duration, options MidiOptions) (*midiControl, *recorder) {
+	tb.Helper()
+	drv := testdrv.New("test")
+	ins, _ := drv.Ins()
+	rec := &recorder{}
+	if err := ins[0].Open(); err != nil {
+		tb.Fatal(err)
+	}
+	ins[0].SetListener(rec.listen)
+
+	mc := NewMIDIController(drv, "test", delay, 0, options).(*midiControl)
+	if err := mc.Open(); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { mc.Close() })
+	return mc, rec
+}
+
+// floodCommands returns the i-th command of an alternating stream of repeated wheel and button commands
+func floodCommands(i int) Command {
+	if i%2 == 0 {
+		return Command{Type: ControlChange, Data1: 1, Data2: uint8(i % 128), Repeat: true}
+	}
+	return Command{Type: ControlChange, Data1: 3, Data2: uint8(i / 2 % 2 * 127)}
+}
+
+func BenchmarkSend(b *testing.B) {
+	mc, _ := openTestController(b, time.Millisecond, MidiOptions{})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := mc.Send(floodCommands(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSendRamped(b *testing.B) {
+	mc, _ := openTestController(b, time.Millisecond, MidiOptions{RampStep: 4, MaxRate: 1000})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := mc.Send(floodCommands(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSendStress(t *testing.T) {
+	const senders, commands = 8, 5000
+
+	before := runtime.NumGoroutine()
+	mc, rec := openTestController(t, time.Millisecond, MidiOptions{})
+
+	// the goroutines are sampled during the flood, as a leak per message would be gone after it
+	stop := make(chan struct{})
+	peak := make(chan int)
+	go func() {
+		max := 0
+		for {
+			select {
+			case <-stop:
+				peak <- max
+				return
+			case <-time.After(time.Millisecond):
+				if n := runtime.NumGoroutine(); n > max {
+					max = n
+				}
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for s := 0; s < senders; s++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < commands; i++ {
+					if err := mc.Send(floodCommands(i)); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		// the last command may still be queued
+		for len(rec.messages()) < senders*commands {
+			time.Sleep(time.Millisecond)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+		t.Fatal("Send deadlocked")
+	}
+	close(stop)
+	if max := <-peak; max > before+senders+10 {
+		t.Errorf("%v goroutines during the flood, %v before", max, before)
+	}
+
+	closed := make(chan error)
+	go func() { closed <- mc.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close deadlocked")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := runtime.NumGoroutine(); n > before+2 {
+		t.Errorf("%v goroutines after Close, %v before", n, before)
+	}
+}
+
+// count returns the number of messages with the status byte and the first data byte
+func count(msgs [][]byte, status byte, data1 byte) int {
+	n := 0
+	for _, m := range msgs {
+		if len(m) > 1 && m[0] == status && m[1] == data1 {
+			n++
+		}
+	}
+	return n
+}
+
+// waitProcessed waits until the executor started or stopped repeating the command, as Send returns once it is queued
+func waitProcessed(t *testing.T, mc *midiControl, cmd Command) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		repeating := false
+		for _, r := range mc.Repeats() {
+			repeating = repeating || r.Command.key() == cmd.key()
+		}
+		if repeating == cmd.Repeat {
+			return
+		}
+	}
+	t.Fatalf("%v not processed", cmd)
+}
+
+func TestRepeatLifecycle(t *testing.T) {
+	repeating := []Command{
+		{Type: ControlChange, Data1: 1, Data2: 10, Repeat: true, Delay: 20 * time.Millisecond},
+		{Type: NoteOn, Channel: 10, Data1: 60, Data2: 100, Repeat: true, Delay: 20 * time.Millisecond},
+	}
+	tests := []struct {
+		name     string
+		commands []Command
+		action   func(mc *midiControl) error
+		wait     time.Duration
+		expected map[[2]byte]int // number of messages by status and first data byte
+	}{
+		{
+			name:     "repeat stops after midiMaxRepeat",
+			commands: []Command{{Type: ControlChange, Data1: 1, Data2: 10, Repeat: true, Delay: time.Millisecond}},
+			wait:     500 * time.Millisecond,
+			expected: map[[2]byte]int{{0xB0, 1}: midiMaxRepeat},
+		},
+		{
+			name:     "command for the same controller cancels the repeat",
+			commands: []Command{repeating[0], {Type: ControlChange, Data1: 1, Data2: 0}},
+			expected: map[[2]byte]int{{0xB0, 1}: 2},
+		},
+		{
+			name:     "StopValue cancels the repeat without a message",
+			commands: []Command{repeating[0], {Type: ControlChange, Data1: 1, Data2: StopValue}},
+			expected: map[[2]byte]int{{0xB0, 1}: 1},
+		},
+		{
+			name:     "Panic clears all repeats",
+			commands: repeating,
+			action:   (*midiControl).Panic,
+			expected: map[[2]byte]int{{0xB0, 1}: 1, {0x99, 60}: 1, {0xB0, midiAllNotesOff}: 1},
+		},
+		{
+			name:     "Close clears all repeats",
+			commands: repeating,
+			action:   (*midiControl).Close,
+			expected: map[[2]byte]int{{0xB0, 1}: 1, {0x99, 60}: 1},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			mc, rec := openTestController(t, 100*time.Millisecond, MidiOptions{})
+			for _, cmd := range tt.commands {
+				if err := mc.Send(cmd); err != nil {
+					t.Fatal(err)
+				}
+				waitProcessed(t, mc, cmd)
+			}
+			if tt.action != nil {
+				if err := tt.action(mc); err != nil {
+					t.Fatal(err)
+				}
+			}
+			wait := tt.wait
+			if wait == 0 {
+				wait = 50 * time.Millisecond
+			}
+			time.Sleep(wait)
+
+			if repeats := mc.Repeats(); len(repeats) > 0 {
+				t.Errorf("still repeating %v", repeats)
+			}
+			msgs := rec.messages()
+			for k, n := range tt.expected {
+				if c := count(msgs, k[0], k[1]); c != n {
+					t.Errorf("% X sent %v times, expected %v", k, c, n)
+				}
+			}
+			// nothing is sent once the repeats stopped
+			time.Sleep(50 * time.Millisecond)
+			if after := rec.messages(); len(after) != len(msgs) {
+				t.Errorf("% X sent after the repeats stopped", after[len(msgs):])
+			}
+		})
+	}
+}
+
+// blockingOut is an output port whose writes block until unblock is closed, like the driver on a deleted port
+type blockingOut struct {
+	midi.Out
+	unblock chan struct{}
+}
+
+func (o *blockingOut) Write(b []byte) (int, error) {
+	<-o.unblock
+	return len(b), nil
+}
+
+// blockingDriver is the test driver with a blocking output port
+type blockingDriver struct {
+	*testdrv.Driver
+	out *blockingOut
+}
+
+func (d *blockingDriver) Outs() ([]midi.Out, error) { return []midi.Out{d.out}, nil }
+
+func TestWriteTimeout(t *testing.T) {
+	drv := testdrv.New("test")
+	outs, _ := drv.Outs()
+	out := &blockingOut{Out: outs[0], unblock: make(chan struct{})}
+	defer close(out.unblock)
+
+	stalled := make(chan struct{}, 1)
+	mc := NewMIDIController(&blockingDriver{Driver: drv, out: out}, "test", time.Millisecond, 0, MidiOptions{
+		OnStall: func() { stalled <- struct{}{} },
+	})
+	if err := mc.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+
+	before := runtime.NumGoroutine()
+	if err := mc.Send(Command{Type: ControlChange, Data1: 1, Data2: 10, Repeat: true}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stalled:
+	case <-time.After(midiWriteTimeout + time.Second):
+		t.Fatal("OnStall not called")
+	}
+
+	// the writes of the repeats and Test fail immediately without starting further goroutines
+	if err := mc.Test(); !errors.Is(err, ErrMIDIWriteTimeout) {
+		t.Errorf("Test returned %v, expected %v", err, ErrMIDIWriteTimeout)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := runtime.NumGoroutine(); n > before+1 {
+		t.Errorf("%v goroutines after the stall, %v before", n, before)
+	}
+}
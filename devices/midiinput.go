@@ -0,0 +1,88 @@
+package devices
+
+import (
+	"log"
+
+	"gitlab.com/gomidi/midi"
+	"gitlab.com/gomidi/midi/reader"
+	"gitlab.com/gomidi/rtmididrv"
+)
+
+// MidiInput receives the messages of a MIDI input device, e.g. a loopMIDI port the host sends its state to
+type MidiInput struct {
+	DeviceName string
+	ExactMatch bool
+	drv        midi.Driver
+	input      midi.In
+}
+
+// Open opens the MIDI input device and passes every program change, control change and note on message received to
+// handler as Command with a channel of 1-16. handler is called by the driver and must not block. Failures are returned as
+// DeviceError of the kinds ErrMIDIDriverInit, ErrMIDIDeviceNotFound and ErrMIDIDeviceBusy
+func (mi *MidiInput) Open(handler func(Command)) error {
+	if mi.drv == nil {
+		drv, err := rtmididrv.New()
+		if err != nil {
+			return &DeviceError{Op: "open", Kind: ErrMIDIDriverInit, Err: err}
+		}
+		mi.drv = drv
+	}
+
+	ins, err := mi.drv.Ins()
+	if err != nil {
+		return &DeviceError{Op: "list", Kind: ErrMIDIDriverInit, Err: err}
+	}
+	names := make([]string, 0, len(ins))
+	for _, v := range ins {
+		names = append(names, v.String())
+	}
+	i := MatchMIDIDevice(names, mi.DeviceName, mi.ExactMatch)
+	if i < 0 {
+		return &DeviceError{Device: mi.DeviceName, Op: "open", Kind: ErrMIDIDeviceNotFound}
+	}
+	log.Printf("Using MIDI input %v: %v\n", i, names[i])
+
+	if err := ins[i].Open(); err != nil {
+		return &DeviceError{Device: names[i], Op: "open", Kind: ErrMIDIDeviceBusy, Err: err}
+	}
+	rd := reader.New(reader.NoLogger(),
+		reader.ProgramChange(func(_ *reader.Position, channel, program uint8) {
+			handler(Command{Type: ProgramChange, Channel: channel + 1, Data1: program})
+		}),
+		reader.ControlChange(func(_ *reader.Position, channel, controller, value uint8) {
+			handler(Command{Type: ControlChange, Channel: channel + 1, Data1: controller, Data2: value})
+		}),
+		reader.NoteOn(func(_ *reader.Position, channel, key, velocity uint8) {
+			handler(Command{Type: NoteOn, Channel: channel + 1, Data1: key, Data2: velocity})
+		}),
+	)
+	if err := rd.ListenTo(ins[i]); err != nil {
+		ins[i].Close()
+		return &DeviceError{Device: names[i], Op: "listen", Kind: ErrMIDIDeviceBusy, Err: err}
+	}
+	mi.input = ins[i]
+	return nil
+}
+
+// Close stops listening and closes the MIDI input device and the driver
+func (mi *MidiInput) Close() error {
+	var errin, errdrv error
+	if mi.input != nil {
+		mi.input.StopListening()
+		errin = mi.input.Close()
+		mi.input = nil
+	}
+	if mi.drv != nil {
+		errdrv = mi.drv.Close()
+	}
+	if errin != nil {
+		return errin
+	}
+	return errdrv
+}
+
+// NewMIDIInput creates a new MidiInput for the device with the given name, which is matched like the device of a
+// MidiController. If nil is passed as driver the default driver will be used (rtmididrv). The input isn't opened
+func NewMIDIInput(driver midi.Driver, devicename string, exact bool) *MidiInput {
+	return &MidiInput{drv: driver, DeviceName: devicename, ExactMatch: exact}
+}
@@ -0,0 +1,47 @@
+package devices
+
+import (
+	"errors"
+	"testing"
+
+	"gitlab.com/gomidi/midi/testdrv"
+)
+
+func TestMidiInput(t *testing.T) {
+	drv := testdrv.New("test")
+	var received []Command
+	mi := NewMIDIInput(drv, "test", false)
+	if err := mi.Open(func(cmd Command) { received = append(received, cmd) }); err != nil {
+		t.Fatal(err)
+	}
+	defer mi.Close()
+
+	// the test driver passes everything written to its output synchronously to the listener of its input
+	outs, _ := drv.Outs()
+	if err := outs[0].Open(); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range [][]byte{{0xC2, 5}, {0x90, 60, 100}, {0xB0, 20, 3}} {
+		if _, err := outs[0].Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []Command{{Type: ProgramChange, Channel: 3, Data1: 5}, {Type: NoteOn, Channel: 1, Data1: 60, Data2: 100},
+		{Type: ControlChange, Channel: 1, Data1: 20, Data2: 3}}
+	if len(received) != len(expected) {
+		t.Fatalf("received %v, expected %v", received, expected)
+	}
+	for i := range expected {
+		if received[i] != expected[i] {
+			t.Errorf("command %v is %v, expected %v", i, received[i], expected[i])
+		}
+	}
+}
+
+func TestMidiInputNotFound(t *testing.T) {
+	mi := NewMIDIInput(testdrv.New("test"), "missing", false)
+	if err := mi.Open(func(Command) {}); !errors.Is(err, ErrMIDIDeviceNotFound) {
+		t.Errorf("error %v, expected %v", err, ErrMIDIDeviceNotFound)
+	}
+}
@@ -0,0 +1,120 @@
+package devices
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+
+	"gitlab.com/gomidi/midi"
+)
+
+// oscDefaultAddress is the OSC address pattern of the messages, if the osc:// URL doesn't contain a path
+const oscDefaultAddress = "/midi"
+
+// oscDriver is a midi.Driver with a single output port, which sends every MIDI message as OSC message over UDP. It
+// allows the MidiController to drive OSC hosts with the same repeating, ramping and rate limiting as MIDI devices
+type oscDriver struct {
+	out *oscOut
+}
+
+func (d *oscDriver) Ins() ([]midi.In, error)   { return nil, nil }
+func (d *oscDriver) Outs() ([]midi.Out, error) { return []midi.Out{d.out}, nil }
+func (d *oscDriver) String() string            { return "osc" }
+func (d *oscDriver) Close() error              { return d.out.Close() }
+
+// oscOut sends each MIDI message written as OSC message to the address pattern. The message has a single argument of
+// the OSC type "m": port id 0, status byte and up to two data bytes
+type oscOut struct {
+	host    string
+	address string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// Open connects the UDP socket to the host
+func (o *oscOut) Open() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.conn != nil {
+		return nil
+	}
+	conn, err := net.Dial("udp", o.host)
+	if err != nil {
+		return err
+	}
+	o.conn = conn
+	return nil
+}
+
+// Close closes the UDP socket
+func (o *oscOut) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.conn == nil {
+		return nil
+	}
+	err := o.conn.Close()
+	o.conn = nil
+	return err
+}
+
+func (o *oscOut) IsOpen() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.conn != nil
+}
+
+func (o *oscOut) Number() int             { return 0 }
+func (o *oscOut) String() string          { return "osc://" + o.host + o.address }
+func (o *oscOut) Underlying() interface{} { return o.conn }
+
+// Write sends the MIDI message as OSC message
+func (o *oscOut) Write(b []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.conn == nil {
+		return 0, midi.ErrPortClosed
+	}
+	if _, err := o.conn.Write(oscMessage(o.address, b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// oscMessage encodes the MIDI message as OSC message with a single "m" argument. Messages longer than three bytes are
+// truncated
+func oscMessage(address string, b []byte) []byte {
+	var buf bytes.Buffer
+	oscString(&buf, address)
+	oscString(&buf, ",m")
+	var m [4]byte
+	copy(m[1:], b)
+	buf.Write(m[:])
+	return buf.Bytes()
+}
+
+// oscString writes the OSC string: the string terminated by at least one zero byte and padded to a multiple of 4 bytes
+func oscString(buf *bytes.Buffer, s string) {
+	buf.WriteString(s)
+	buf.Write(make([]byte, 4-len(s)%4))
+}
+
+// newOSCControllerFromURL creates a MidiController for an osc:// URL
+func newOSCControllerFromURL(u *url.URL, options MidiOptions) (MidiController, error) {
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, errors.New("no OSC host and port specified in " + u.String())
+	}
+	address := u.Path
+	if address == "" || address == "/" {
+		address = oscDefaultAddress
+	}
+	channel, delay, options, err := controllerQuery(u, options)
+	if err != nil {
+		return nil, err
+	}
+	drv := &oscDriver{out: &oscOut{host: u.Host, address: address}}
+	return NewMIDIController(drv, drv.out.String(), delay, channel-1, options), nil
+}
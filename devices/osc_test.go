@@ -0,0 +1,40 @@
+package devices
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOSCController(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	mc, err := NewController("osc://" + conn.LocalAddr().String() + "/sdr?channel=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+	if err := mc.Send(Command{Type: ControlChange, Data1: 3, Data2: 127}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// address "/sdr" and type tags ",m" padded to 4 bytes, followed by port id, status and data bytes
+	expected := []byte{'/', 's', 'd', 'r', 0, 0, 0, 0, ',', 'm', 0, 0, 0, 0xB1, 3, 127}
+	if !bytes.Equal(buf[:n], expected) {
+		t.Errorf("received % X, expected % X", buf[:n], expected)
+	}
+}
@@ -2,6 +2,10 @@ package devices
 
 import (
 	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/bearsh/hid"
 )
@@ -12,13 +16,51 @@ const (
 	shuttlexpress_productId = 0x0020
 )
 
+// shuttlexpress_reportSize is the size of the HID input report of the ShuttlExpress in bytes
+const shuttlexpress_reportSize = 5
+
+// reportLayout contains the byte positions of the controls in the HID input report
+type reportLayout struct {
+	wheel   int // signed wheel position
+	dial    int // dial counter
+	buttons int // buttons 1 to 4 in the upper nibble
+	button5 int // button 5 in bit 0
+}
+
+// shuttlexpress_layout is the report layout of the ShuttlExpress
+var shuttlexpress_layout = reportLayout{wheel: 0, dial: 1, buttons: 3, button5: 4}
+
+// shuttlexpress_reconnectDelay is the time between two attempts to reopen the device after the reader stopped
+const shuttlexpress_reconnectDelay = 2 * time.Second
+
+// shuttlexpress_resumeDetents is the maximum dial counter of the first report after a reconnect, which is sent as
+// detents by SetDialResume. The device counts from 0 after it was plugged in, larger values are assumed to be stale
+const shuttlexpress_resumeDetents = 3
+
 var (
 	ErrShuttleExpressDeviceNotFound  = errors.New("no ShuttlExpress found")
 	ErrShuttleExpressDeviceNotOpened = errors.New("ShuttlExpress: No device opened")
+	// ErrShuttleExpressDeviceBusy is returned if a ShuttlExpress is connected, but can't be opened. hidapi doesn't report
+	// the reason, which usually is another application holding the device or missing permissions
+	ErrShuttleExpressDeviceBusy = errors.New("ShuttlExpress is in use by another application or access is denied")
 )
 
+// ButtonState contains the pressed state of all five buttons as bitmask. Bit 0 represents button 1
+type ButtonState uint8
+
+// Pressed returns true if the given button (1-5) is pressed
+func (bs ButtonState) Pressed(button int) bool {
+	return bs&(1<<(button-1)) != 0
+}
+
 // ShuttleStatus contains a event channel for all ShuttlExpress hardware controls.
 // The channels have to be created by the consuming module.
+// Buttons receives the state of all buttons of a report whenever at least one button changed. It is sent before the
+// events of the individual buttons.
+// Events receives a typed Event for every change of a control, after the control specific channel.
+// Errors receives the error whenever the reader stopped, before the device is reopened. The error is dropped if it
+// isn't received immediately.
+// Events and Errors are created by Subscribe, if the consumers change over time.
 type ShuttleStatus struct {
 	Wheel_position  chan int8
 	Dial_direction  chan int8
@@ -27,21 +69,55 @@ type ShuttleStatus struct {
 	Button3_pressed chan bool
 	Button4_pressed chan bool
 	Button5_pressed chan bool
+	Buttons         chan ButtonState
+	Events          chan Event
+	Errors          chan error
 
 	wheel_value   int8
+	wheel_current int32 // copy of wheel_value for WheelPosition, accessed atomically
+	log_reports   int32 // logs all raw reports if not 0, accessed atomically
+	dial_filter   int32 // number of detents required after a direction reversal, accessed atomically
+	dial_dir      int8  // direction of the last dial event
+	dial_reversed int32 // number of consecutive detents against dial_dir
+	dial_resume   int32 // sends the first detents after a reconnect if not 0, accessed atomically
 	dial_value    uint8
-	button1_value bool
-	button2_value bool
-	button3_value bool
-	button4_value bool
-	button5_value bool
+	dial_valid    bool
+	reopened      bool // the device was reopened by the watchdog, the dial counter restarted at 0
+	buttons_value ButtonState
+	missing       uint8 // bitmask of the controls which were missing in a report, used to log them only once
+}
+
+// DeviceFilter selects the HID interface of the ShuttlExpress to open, if the HID stack reports several. A UsagePage or
+// Usage of 0 and a negative Interface match any value. UsagePage and Usage are only reported on Windows and macOS
+type DeviceFilter struct {
+	UsagePage uint16
+	Usage     uint16
+	Interface int
+}
+
+// AnyInterface is the DeviceFilter opening the first interface found
+var AnyInterface = DeviceFilter{Interface: -1}
+
+// matches returns true if the interface described by di passes the filter
+func (f DeviceFilter) matches(di hid.DeviceInfo) bool {
+	return (f.UsagePage == 0 || f.UsagePage == di.UsagePage) && (f.Usage == 0 || f.Usage == di.Usage) &&
+		(f.Interface < 0 || f.Interface == di.Interface)
 }
 
 // ShuttlExpress Driver based on the hardware information from the Python implementation https://github.com/EMATech/ContourShuttleXpress
 type ShuttlExpress struct {
+	reports uint64 // number of reports received, accessed atomically. Kept first for alignment
+
 	devhandle *hid.Device
 	devinfo   hid.DeviceInfo
+	infomu    sync.Mutex // guards devinfo, which is replaced when the watchdog reopens the device
+	filter    DeviceFilter
 	err       error
+	errmu     sync.Mutex
+	simmu     sync.Mutex // serializes simulated reports
+	submu     sync.Mutex // guards sub and the Events and Errors channels created by Subscribe
+	sub       *subscription
+	forwards  bool // Events and Errors were created by Subscribe
 
 	ShuttleStatus
 }
@@ -49,77 +125,393 @@ type ShuttlExpress struct {
 // readdevice is a goroutine and continously reads the device status and sends out events through the channels part of ShuttleStatus
 func (se *ShuttlExpress) readdevice() {
 	if se.devhandle == nil {
-		se.err = ErrShuttleExpressDeviceNotOpened
+		se.setErr(ErrShuttleExpressDeviceNotOpened)
 		return
 	}
 	se.devhandle.SetNonblocking(false)
 
 	for {
 		var buf = make([]byte, 48)
-		if _, err := se.devhandle.Read(buf); err != nil {
-			se.err = err
+		n, err := se.devhandle.Read(buf)
+		if err != nil {
+			se.setErr(err)
 			return
 		}
-		wheel_pos := int8(buf[0])
-		dial_pos := uint8(buf[1])
-		b1_pressed := buf[3]&(1<<4) > 0
-		b2_pressed := buf[3]&(1<<5) > 0
-		b3_pressed := buf[3]&(1<<6) > 0
-		b4_pressed := buf[3]&(1<<7) > 0
-		b5_pressed := buf[4]&(1<<0) > 0
-
-		if wheel_pos != se.wheel_value && se.Wheel_position != nil {
-			se.Wheel_position <- wheel_pos
-			se.wheel_value = wheel_pos
+		if atomic.LoadInt32(&se.log_reports) != 0 {
+			log.Printf("ShuttlExpress: report: % x\n", buf[:n])
+		}
+		if n == 0 || n > shuttlexpress_reportSize {
+			log.Printf("ShuttlExpress: skipping report with unexpected size %v: % x\n", n, buf[:n])
+			continue
 		}
-		if dial_pos != se.dial_value && se.Dial_direction != nil {
-			dial_delta := int8(dial_pos - se.dial_value)
+		se.handleReport(buf[:n])
+	}
+}
 
-			// only use if difference is a single step. Else it's the first read
-			if dial_delta == 1 || dial_delta == -1 {
-				se.Dial_direction <- dial_delta
-			}
-			se.dial_value = dial_pos
+// available returns true if the report contains the byte at index used by the control. A missing byte is logged once
+// per control
+func (se *ShuttlExpress) available(buf []byte, index int, c Control) bool {
+	if index < len(buf) {
+		return true
+	}
+	if se.missing&(1<<c) == 0 {
+		se.missing |= 1 << c
+		log.Printf("ShuttlExpress: report of size %v doesn't contain %v\n", len(buf), c)
+	}
+	return false
+}
+
+// handleReport decodes a single HID input report and sends out events for all controls which changed. Controls missing
+// in a shorter report don't send any events
+func (se *ShuttlExpress) handleReport(buf []byte) {
+	atomic.AddUint64(&se.reports, 1)
+
+	l := shuttlexpress_layout
+	wheel_pos, dial_pos, buttons := se.wheel_value, se.dial_value, se.buttons_value
+	if se.available(buf, l.wheel, Wheel) {
+		wheel_pos = int8(buf[l.wheel])
+	}
+	dial_present := se.available(buf, l.dial, Dial)
+	if dial_present {
+		dial_pos = uint8(buf[l.dial])
+	}
+	if se.available(buf, l.buttons, Button1) {
+		buttons = buttons&^0x0f | ButtonState(buf[l.buttons]>>4)
+	}
+	if se.available(buf, l.button5, Button5) {
+		buttons = buttons&^0x10 | ButtonState(buf[l.button5]&1)<<4
+	}
+
+	if wheel_pos != se.wheel_value {
+		se.wheel_value = wheel_pos
+		atomic.StoreInt32(&se.wheel_current, int32(wheel_pos))
+		if se.Wheel_position != nil {
+			se.Wheel_position <- wheel_pos
 		}
-		if b1_pressed != se.button1_value && se.Button1_pressed != nil {
-			se.Button1_pressed <- b1_pressed
-			se.button1_value = b1_pressed
+		se.emit(Wheel, int(wheel_pos))
+	}
+	if dial_present && !se.dial_valid {
+		// the first read after opening the device only provides the reference position of the dial. After a reconnect
+		// the counter restarted at 0, so the detents turned since then can be sent if enabled by SetDialResume
+		se.dial_value = dial_pos
+		se.dial_valid = true
+		if delta := int8(dial_pos); se.reopened && atomic.LoadInt32(&se.dial_resume) != 0 && abs8(delta) <= shuttlexpress_resumeDetents {
+			se.emitDetents(delta)
 		}
-		if b2_pressed != se.button2_value && se.Button1_pressed != nil {
-			se.Button2_pressed <- b2_pressed
-			se.button2_value = b2_pressed
+		se.reopened = false
+	} else if dial_pos != se.dial_value {
+		dial_delta := int8(dial_pos - se.dial_value)
+		se.dial_value = dial_pos
+		se.emitDetents(dial_delta)
+	}
+	if buttons != se.buttons_value {
+		previous := se.buttons_value
+		se.buttons_value = buttons
+		if se.Buttons != nil {
+			se.Buttons <- buttons
 		}
-		if b3_pressed != se.button3_value && se.Button1_pressed != nil {
-			se.Button3_pressed <- b3_pressed
-			se.button3_value = b3_pressed
+		for i, ch := range []chan bool{se.Button1_pressed, se.Button2_pressed, se.Button3_pressed, se.Button4_pressed, se.Button5_pressed} {
+			pressed := buttons.Pressed(i + 1)
+			if pressed == previous.Pressed(i+1) {
+				continue
+			}
+			if ch != nil {
+				ch <- pressed
+			}
+			value := 0
+			if pressed {
+				value = 1
+			}
+			se.emit(Button1+Control(i), value)
 		}
-		if b4_pressed != se.button4_value && se.Button1_pressed != nil {
-			se.Button4_pressed <- b4_pressed
-			se.button4_value = b4_pressed
+	}
+}
+
+// emitDetents sends a single event for each detent, even if the dial was turned multiple steps between two reports
+func (se *ShuttlExpress) emitDetents(delta int8) {
+	for ; delta != 0; delta -= sign(delta) {
+		if !se.acceptDetent(sign(delta)) {
+			continue
 		}
-		if b5_pressed != se.button5_value && se.Button1_pressed != nil {
-			se.Button5_pressed <- b5_pressed
-			se.button5_value = b5_pressed
+		if se.Dial_direction != nil {
+			se.Dial_direction <- sign(delta)
 		}
+		se.emit(Dial, int(sign(delta)))
 	}
 }
 
-// NewShuttlExpress searches for available ShuttlExpress devices and opens the first one it finds
-func NewShuttlExpress() (*ShuttlExpress, error) {
+// acceptDetent filters the jitter of the dial. A detent against the direction of the last event is only accepted, once
+// the number of consecutive detents in the new direction reaches the value set by SetDialFilter
+func (se *ShuttlExpress) acceptDetent(direction int8) bool {
+	filter := atomic.LoadInt32(&se.dial_filter)
+	if filter <= 1 || se.dial_dir == 0 || direction == se.dial_dir {
+		se.dial_dir, se.dial_reversed = direction, 0
+		return true
+	}
+	se.dial_reversed++
+	if se.dial_reversed >= filter {
+		se.dial_dir, se.dial_reversed = direction, 0
+		return true
+	}
+	return false
+}
+
+// emit sends an Event for the control to the Events channel, if it was created by the consuming module
+func (se *ShuttlExpress) emit(c Control, value int) {
+	if events, _ := se.channels(); events != nil {
+		events <- Event{Control: c, Value: value, Time: time.Now()}
+	}
+}
+
+// channels returns the Events and Errors channels
+func (se *ShuttlExpress) channels() (chan Event, chan error) {
+	se.submu.Lock()
+	defer se.submu.Unlock()
+	return se.Events, se.Errors
+}
+
+// subscription receives the events and errors forwarded to the subscriber of Subscribe until quitch is closed
+type subscription struct {
+	events chan Event
+	errors chan error
+	quitch chan struct{}
+}
+
+// Subscribe returns channels receiving the events and errors of the device until quitch is closed. The first call
+// creates the Events and Errors channels, which are read by a forwarder for the lifetime of the device. So the reader
+// isn't blocked while the consumer changes, e.g. when the Mapper is restarted with a new configuration. Events and
+// errors are dropped while there is no subscriber. A later subscription replaces an earlier one
+func (se *ShuttlExpress) Subscribe(quitch chan struct{}) (<-chan Event, <-chan error) {
+	sub := &subscription{events: make(chan Event), errors: make(chan error), quitch: quitch}
+	se.submu.Lock()
+	defer se.submu.Unlock()
+	if !se.forwards {
+		se.forwards = true
+		se.Events, se.Errors = make(chan Event), make(chan error, 1)
+		go se.forward(se.Events, se.Errors)
+	}
+	se.sub = sub
+	return sub.events, sub.errors
+}
+
+// subscriber returns the current subscription, nil if there is none or it was closed
+func (se *ShuttlExpress) subscriber() *subscription {
+	se.submu.Lock()
+	defer se.submu.Unlock()
+	if se.sub == nil {
+		return nil
+	}
+	select {
+	case <-se.sub.quitch:
+		se.sub = nil
+	default:
+	}
+	return se.sub
+}
 
-	di := hid.Enumerate(shuttlexpress_vendorId, shuttlexpress_productId)
+// forward is a goroutine passing the events and errors to the current subscriber
+func (se *ShuttlExpress) forward(events chan Event, errors chan error) {
+	for {
+		select {
+		case e := <-events:
+			if sub := se.subscriber(); sub != nil {
+				select {
+				case sub.events <- e:
+				case <-sub.quitch:
+				}
+			}
+		case err := <-errors:
+			if sub := se.subscriber(); sub != nil {
+				select {
+				case sub.errors <- err:
+				case <-sub.quitch:
+				}
+			}
+		}
+	}
+}
+
+// sign returns 1 for positive and -1 for negative values
+func sign(v int8) int8 {
+	if v < 0 {
+		return -1
+	}
+	return 1
+}
+
+// abs8 returns the absolute value of v
+func abs8(v int8) int8 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// watchdog is a goroutine and runs readdevice. Whenever readdevice stops, the underlying error is logged and the device
+// is re-enumerated and reopened until it is available again, before the reader is restarted
+func (se *ShuttlExpress) watchdog() {
+	for {
+		se.readdevice()
+		err := se.Err()
+		log.Printf("ShuttlExpress: reader stopped: %v\n", err)
+		if _, errors := se.channels(); errors != nil {
+			select {
+			case errors <- err:
+			default:
+			}
+		}
+
+		if se.devhandle != nil {
+			se.devhandle.Close()
+			se.devhandle = nil
+		}
+		for {
+			time.Sleep(shuttlexpress_reconnectDelay)
+			if err := se.open(); err == nil {
+				break
+			}
+		}
+		se.reopened = true
+		log.Printf("ShuttlExpress: reconnected to %v\n", se.DeviceInfo().Path)
+	}
+}
+
+// open searches for available ShuttlExpress devices and opens the first one passing the filter
+func (se *ShuttlExpress) open() error {
+	var di []hid.DeviceInfo
+	for _, d := range hid.Enumerate(shuttlexpress_vendorId, shuttlexpress_productId) {
+		if se.filter.matches(d) {
+			di = append(di, d)
+		} else {
+			log.Printf("ShuttlExpress: skipping interface %v, Usage Page: %x, Usage: %x, Path: %v\n", d.Interface, d.UsagePage, d.Usage, d.Path)
+		}
+	}
 	if len(di) == 0 {
-		return nil, ErrShuttleExpressDeviceNotFound
+		return ErrShuttleExpressDeviceNotFound
 	}
 
 	dev, err := di[0].Open()
 	if err != nil {
+		return &DeviceError{Device: di[0].Path, Op: "open", Kind: ErrShuttleExpressDeviceBusy, Err: err}
+	}
+
+	se.devhandle = dev
+	se.infomu.Lock()
+	se.devinfo = di[0]
+	se.infomu.Unlock()
+	se.setErr(nil)
+	// the dial counter of the device isn't related to the one before, forget its direction and position
+	se.dial_valid, se.dial_dir, se.dial_reversed, se.reopened = false, 0, 0, false
+	log.Printf("ShuttlExpress: opened %v %v, Serial: %v, Release: %x, Interface: %v, Usage Page: %x, Usage: %x, Path: %v\n",
+		di[0].Manufacturer, di[0].Product, di[0].Serial, di[0].Release, di[0].Interface, di[0].UsagePage, di[0].Usage, di[0].Path)
+	return nil
+}
+
+// setErr stores the error of the reader
+func (se *ShuttlExpress) setErr(err error) {
+	se.errmu.Lock()
+	defer se.errmu.Unlock()
+	se.err = err
+}
+
+// Err returns the error which stopped the reader. nil is returned while the device is opened and read
+func (se *ShuttlExpress) Err() error {
+	se.errmu.Lock()
+	defer se.errmu.Unlock()
+	return se.err
+}
+
+// Simulate feeds a change of the control into the event handling as if it was reported by the device. value contains
+// the wheel position (-7 to 7), the number of dial detents or the button state (1 pressed, 0 released)
+func (se *ShuttlExpress) Simulate(c Control, value int) {
+	se.simmu.Lock()
+	defer se.simmu.Unlock()
+
+	l := shuttlexpress_layout
+	report := make([]byte, shuttlexpress_reportSize)
+	report[l.wheel] = byte(se.wheel_value)
+	report[l.dial] = se.dial_value
+	buttons := se.buttons_value
+	switch {
+	case c == Wheel:
+		report[l.wheel] = byte(int8(value))
+	case c == Dial:
+		report[l.dial] = se.dial_value + uint8(value)
+	case c >= Button1 && c <= Button5:
+		if value != 0 {
+			buttons |= 1 << (c - Button1)
+		} else {
+			buttons &^= 1 << (c - Button1)
+		}
+	}
+	report[l.buttons] |= byte(buttons << 4)
+	report[l.button5] |= byte(buttons>>4) & 1
+	se.handleReport(report)
+}
+
+// SetLogReports enables or disables logging the raw bytes of every HID report read from the device
+func (se *ShuttlExpress) SetLogReports(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&se.log_reports, v)
+}
+
+// SetDialFilter sets the number of consecutive detents required after the dial reversed its direction, before events
+// are sent again. Values up to 1 disable the filter
+func (se *ShuttlExpress) SetDialFilter(detents int) {
+	atomic.StoreInt32(&se.dial_filter, int32(detents))
+}
+
+// SetDialResume enables sending the detents reported by the first report after the device was reconnected. By default
+// the first report only sets the reference position of the dial and the first detent after a reconnect is suppressed
+func (se *ShuttlExpress) SetDialResume(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&se.dial_resume, v)
+}
+
+// Reports returns the number of reports received from the device
+func (se *ShuttlExpress) Reports() uint64 {
+	return atomic.LoadUint64(&se.reports)
+}
+
+// WheelPosition returns the last position (-7 to 7) reported by the wheel
+func (se *ShuttlExpress) WheelPosition() int8 {
+	return int8(atomic.LoadInt32(&se.wheel_current))
+}
+
+// DeviceInfo returns the USB HID information of the opened device, like product string, serial number and release
+func (se *ShuttlExpress) DeviceInfo() hid.DeviceInfo {
+	se.infomu.Lock()
+	defer se.infomu.Unlock()
+	return se.devinfo
+}
+
+// NewVirtualShuttlExpress creates a ShuttlExpress without hardware. Events are only created by Simulate
+func NewVirtualShuttlExpress() *ShuttlExpress {
+	se := &ShuttlExpress{ShuttleStatus: ShuttleStatus{dial_valid: true}}
+	se.devinfo.Product = "Virtual ShuttlExpress"
+	return se
+}
+
+// NewShuttlExpress searches for available ShuttlExpress devices and opens the first one it finds. The device is monitored
+// and automatically reopened in case it stops responding or is unplugged and plugged in again
+func NewShuttlExpress() (*ShuttlExpress, error) {
+	return NewFilteredShuttlExpress(AnyInterface)
+}
+
+// NewFilteredShuttlExpress works like NewShuttlExpress, but only opens an interface passing the filter
+func NewFilteredShuttlExpress(filter DeviceFilter) (*ShuttlExpress, error) {
+	se := &ShuttlExpress{ShuttleStatus: ShuttleStatus{}, filter: filter}
+	if err := se.open(); err != nil {
 		return nil, err
 	}
 
-	status := ShuttleStatus{}
-	se := &ShuttlExpress{devhandle: dev, devinfo: di[0], err: nil, ShuttleStatus: status}
-	go se.readdevice()
+	go se.watchdog()
 
 	return se, nil
 }
@@ -0,0 +1,56 @@
+package devices
+
+import (
+	"testing"
+	"time"
+)
+
+// simulate feeds the change of the control into the device and fails if the reader is blocked
+func simulate(t *testing.T, se *ShuttlExpress, c Control, value int) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		se.Simulate(c, value)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("reader blocked sending %v %v", c, value)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	se := NewVirtualShuttlExpress()
+
+	quit1 := make(chan struct{})
+	events, _ := se.Subscribe(quit1)
+	go se.Simulate(Button1, 1)
+	if e := <-events; e.Control != Button1 || e.Value != 1 {
+		t.Errorf("first subscriber received %v, expected the press of %v", e, Button1)
+	}
+
+	// without a subscriber the events are dropped instead of blocking the reader
+	close(quit1)
+	simulate(t, se, Button1, 0)
+	simulate(t, se, Wheel, 3)
+	if p := se.WheelPosition(); p != 3 {
+		t.Errorf("wheel position is %v without a subscriber, expected 3", p)
+	}
+
+	quit2 := make(chan struct{})
+	defer close(quit2)
+	events, _ = se.Subscribe(quit2)
+	go se.Simulate(Button2, 1)
+	// the event forwarded while subscribing may still arrive before the press
+	for {
+		select {
+		case e := <-events:
+			if e.Control == Button2 && e.Value == 1 {
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("second subscriber didn't receive the press of %v", Button2)
+		}
+	}
+}
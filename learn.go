@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dg1psi/shuttlemidi/devices"
+	"github.com/dg1psi/shuttlemidi/mapping"
+	"github.com/gen2brain/dlgs"
+)
+
+// LearnConfig contains the MIDI input the learn mode receives the controllers and notes assigned by the host from
+type LearnConfig struct {
+	// MidiDevice is the name of the MIDI input device the host sends to. An empty string disables the learn mode
+	MidiDevice string
+	// Timeout is the time waited for a controller or note after a control is actuated
+	Timeout time.Duration
+}
+
+// learning is 1 while the learn mode of the tray menu is enabled, accessed atomically
+var learning int32
+
+// learnBusy holds a token while learnControl waits for a controller, so controls actuated meanwhile are ignored
+var learnBusy = make(chan struct{}, 1)
+
+// onControl is called by the Mapper for every actuated control. In learn mode it waits for the controller assigned by
+// the host in a new goroutine, unless it is already waiting for another control
+func onControl(control string) {
+	if atomic.LoadInt32(&learning) == 0 {
+		return
+	}
+	select {
+	case learnBusy <- struct{}{}:
+		go func() {
+			defer func() { <-learnBusy }()
+			learnControl(control)
+		}()
+	default:
+	}
+}
+
+// learnControl opens the MIDI input of Learn and waits for the next control change or note on message the host sends
+// after assigning the control in its MIDI learn. After confirmation the controller or note is saved to the mapping of
+// the control and the listeners are restarted with the new mapping
+func learnControl(control string) {
+	lc := currentConfig().Learn
+	if lc.MidiDevice == "" {
+		dlgs.Error(applicationName, "No MIDI input configured for the learn mode. Set MidiDevice of Learn to the MIDI "+
+			"device the host sends to.")
+		return
+	}
+
+	// the driver must not be blocked, messages received after the first one are dropped
+	cmdch := make(chan devices.Command, 1)
+	input := devices.NewMIDIInput(nil, lc.MidiDevice, currentConfig().MidiExactMatch)
+	err := input.Open(func(cmd devices.Command) {
+		if cmd.Type != devices.ControlChange && cmd.Type != devices.NoteOn {
+			return
+		}
+		select {
+		case cmdch <- cmd:
+		default:
+		}
+	})
+	if err != nil {
+		dlgs.Error(applicationName, "Unable to open the MIDI input of the learn mode.\n"+err.Error())
+		return
+	}
+	fmt.Printf("Learning %v, waiting for a controller or note from %v\n", control, lc.MidiDevice)
+
+	var cmd devices.Command
+	select {
+	case cmd = <-cmdch:
+		input.Close()
+	case <-time.After(lc.Timeout):
+		input.Close()
+		fmt.Printf("No controller or note received for %v within %v\n", control, lc.Timeout)
+		return
+	}
+
+	if ok, _ := dlgs.Question(applicationName, fmt.Sprintf("Save %v to the mapping of %v?", learnedName(cmd), control), true); !ok {
+		return
+	}
+	cfg, conflicts, err := learnMapping(control, cmd)
+	if err != nil {
+		dlgs.Error(applicationName, "Unable to save the mapping.\n"+err.Error())
+		return
+	}
+	if len(conflicts) > 0 {
+		dlgs.Warning(applicationName, "Mapping saved with conflicts:\n"+strings.Join(conflicts, "\n"))
+	}
+	startListeners(cfg, cfg.MidiDevice, shuttle)
+}
+
+// learnedName returns the controller or note of the message received in the learn mode for display
+func learnedName(cmd devices.Command) string {
+	if cmd.Type == devices.NoteOn {
+		return fmt.Sprintf("note %v", cmd.Data1)
+	}
+	return fmt.Sprintf("controller %v", cmd.Data1)
+}
+
+// learnedMapping returns m bound to the controller or note of the message received in the learn mode. A control
+// change turns a note mapping into a control change mapping. An error is returned if the result isn't valid for control
+func learnedMapping(m mapping.Mapping, control string, cmd devices.Command) (mapping.Mapping, error) {
+	if m.Name == "" {
+		m.Name = control
+	}
+	if cmd.Type == devices.NoteOn {
+		m.Type, m.Note = mapping.TypeNote, cmd.Data1
+	} else {
+		if strings.EqualFold(m.Type, mapping.TypeNote) {
+			m.Type = ""
+		}
+		m.Controller = cmd.Data1
+	}
+	return m, m.Validate(control)
+}
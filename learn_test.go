@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dg1psi/shuttlemidi/devices"
+	"github.com/dg1psi/shuttlemidi/mapping"
+)
+
+func TestLearnedMapping(t *testing.T) {
+	for _, tt := range []struct {
+		control  string
+		mapping  mapping.Mapping
+		cmd      devices.Command
+		expected mapping.Mapping
+		invalid  bool
+	}{
+		{mapping.ControlDial, mapping.Mapping{}, devices.Command{Type: devices.ControlChange, Data1: 20},
+			mapping.Mapping{Name: mapping.ControlDial, Controller: 20}, false},
+		{mapping.ControlButton1, mapping.Mapping{Name: "Mute", Controller: 3}, devices.Command{Type: devices.NoteOn, Data1: 60, Data2: 100},
+			mapping.Mapping{Name: "Mute", Type: mapping.TypeNote, Controller: 3, Note: 60}, false},
+		{mapping.ControlButton2, mapping.Mapping{Name: "PTT", Type: mapping.TypeNote, Note: 60}, devices.Command{Type: devices.ControlChange, Data1: 7},
+			mapping.Mapping{Name: "PTT", Controller: 7, Note: 60}, false},
+		{mapping.ControlWheelUp, mapping.Mapping{}, devices.Command{Type: devices.NoteOn, Data1: 60}, mapping.Mapping{}, true},
+	} {
+		m, err := learnedMapping(tt.mapping, tt.control, tt.cmd)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("%v: invalid mapping %+v learned", tt.control, m)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.control, err)
+		}
+		if !reflect.DeepEqual(m, tt.expected) {
+			t.Errorf("%v: learned %+v, expected %+v", tt.control, m, tt.expected)
+		}
+	}
+}
@@ -6,12 +6,22 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 
 	"github.com/dg1psi/shuttlemidi/devices"
 	icon "github.com/dg1psi/shuttlemidi/icons"
+	"github.com/dg1psi/shuttlemidi/mapping"
 	"github.com/gen2brain/dlgs"
 	"github.com/getlantern/systray"
 	"github.com/spf13/viper"
@@ -19,151 +29,403 @@ import (
 
 const applicationName = "ShuttleMidi v0.1.3"
 
-var (
-	// configDefaults contain the default configuration written to the configuration file
-	configDefaults = map[string]interface{}{
-		"MidiDevice": "ShuttleMIDI",
-	}
-)
-
 var mcontrol devices.MidiController
 
+// listenersMu serializes starting and stopping the listeners, which is triggered by the tray menu, the API, the mapper
+// and a stalled MIDI device or backend from different goroutines. It protects mcontrol, quitch and backends
+var listenersMu sync.Mutex
+
+// shuttle is the ShuttlExpress device opened by onReady
+var shuttle *devices.ShuttlExpress
+
+// cycleDevice selects the next MIDI device of DeviceCycle. It is set by onReady once the tray menu is created
+var cycleDevice func()
+
+// startOnce makes sure that only one of onReady and runHeadless opens the devices
+var startOnce sync.Once
+
+// trayTimeout is the time to wait for the tray icon before falling back to runHeadless
+const trayTimeout = 10 * time.Second
+
+// claimStart returns true for the first caller, which is responsible for opening the devices
+func claimStart() (first bool) {
+	startOnce.Do(func() { first = true })
+	return first
+}
+
 // quitch is the channel used to stop the goroutine handling the ShuttlExpress events
 var quitch chan struct{}
 
-// readshuttle is the goroutine used to handle all ShuttlExpress events and to send out the MIDI messages.
-// The routine is stopped by closing the quitch channel
-func readshuttle(quitch chan struct{}, se *devices.ShuttlExpress, mc devices.MidiController) {
-	se.Wheel_position = make(chan int8)
-	se.Dial_direction = make(chan int8)
-	se.Button1_pressed = make(chan bool)
-	se.Button2_pressed = make(chan bool)
-	se.Button3_pressed = make(chan bool)
-	se.Button4_pressed = make(chan bool)
-	se.Button5_pressed = make(chan bool)
-
-	for {
-		select {
-		case <-quitch:
-			return
-		case wp := <-se.Wheel_position:
-			if wp > 0 && wp <= 7 {
-				// Invert positive wheel positions to work around bug in SDR Console with Tune Up
-				mc.SendCommand(0, uint8(18*(8-wp)), true)
-			} else if wp >= -7 && wp < 0 {
-				mc.SendCommand(1, uint8(18*(-wp)), true)
-			} else {
-				mc.SendCommand(0, 255, false)
-				mc.SendCommand(1, 255, false)
-			}
-		case dd := <-se.Dial_direction:
-			if dd == 1 {
-				mc.SendCommand(2, 2, false)
-			} else {
-				mc.SendCommand(2, 1, false)
-			}
-		case b1 := <-se.Button1_pressed:
-			if b1 {
-				mc.SendCommand(3, 127, false)
-			} else {
-				mc.SendCommand(3, 0, false)
-			}
-		case b2 := <-se.Button2_pressed:
-			if b2 {
-				mc.SendCommand(4, 127, false)
-			} else {
-				mc.SendCommand(4, 0, false)
-			}
-		case b3 := <-se.Button3_pressed:
-			if b3 {
-				mc.SendCommand(5, 127, false)
-			} else {
-				mc.SendCommand(5, 0, false)
-			}
-		case b4 := <-se.Button4_pressed:
-			if b4 {
-				mc.SendCommand(6, 127, false)
-			} else {
-				mc.SendCommand(6, 0, false)
-			}
-		case b5 := <-se.Button5_pressed:
-			if b5 {
-				mc.SendCommand(7, 127, false)
-			} else {
-				mc.SendCommand(7, 0, false)
-			}
+// mapperOptions returns the options of the wheel, the dial and the gestures shared by the main Mapper and the Mappers
+// of the pipelines
+func mapperOptions(cfg *Config) mapping.Options {
+	return mapping.Options{
+		WheelMax:             cfg.WheelMax,
+		WheelReverse:         cfg.WheelReverse,
+		WheelCenterWindow:    cfg.WheelCenterWindow,
+		WheelPositiveInvert:  cfg.WheelPositiveInvert,
+		WheelNegativeInvert:  cfg.WheelNegativeInvert,
+		WheelFineThreshold:   cfg.WheelFineThreshold,
+		WheelBands:           cfg.WheelBands,
+		WheelStepRate:        cfg.WheelStepRate,
+		WheelStopValue:       cfg.WheelStopValue,
+		WheelStopActive:      cfg.WheelStopActive,
+		WheelIdleTimeout:     cfg.WheelIdleTimeout,
+		WheelReturnTimeout:   cfg.WheelReturnTimeout,
+		DialRepeatWindow:     cfg.DialRepeatWindow,
+		GestureHoldTime:      cfg.GestureHoldTime,
+		GestureDoubleTapTime: cfg.GestureDoubleTapTime,
+		GestureChordWindow:   cfg.GestureChordWindow,
+		OnSend:               streamCommands(cfg),
+	}
+}
+
+// readshuttle is the goroutine used to handle all ShuttlExpress events and to send out the MIDI messages using the
+// mappings of the configuration. The routine is stopped by closing the quitch channel
+func readshuttle(quitch chan struct{}, se *devices.ShuttlExpress, outputs map[string]devices.MidiController, cfg *Config) {
+	options := mapperOptions(cfg)
+	options.Channel = cfg.MidiChannel
+	options.ChannelToggleButton = cfg.ChannelToggle.Button
+	options.ChannelToggleChannels = cfg.ChannelToggle.Channels
+	options.ClockButton = cfg.ClockButton
+	options.PanicButton = cfg.PanicButton
+	options.DeviceCycleButton = cfg.DeviceCycle.Button
+	options.OnDeviceCycle = cycleDevice
+	options.OnControl = onControl
+	options.OnEvent = streamEvents(cfg)
+	options.OnChannel = setTooltip
+	options.State = loadState(cfg)
+	options.OnState = onState(cfg)
+	options.Pipelines = pipelines(cfg, outputs)
+	mapper, err := mapping.NewMapper(cfg.Mappings, options)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	mapper.Run(quitch, se, outputs)
+}
+
+// persistConfig writes the configuration and notifies the user if it was written to the fallback location in the user
+// config directory or couldn't be written at all
+func persistConfig() {
+	path, err := saveConfig()
+	if err != nil {
+		dlgs.Error(applicationName, "Unable to save the configuration. The changes will be lost on exit.\n"+err.Error())
+	} else if path != "" {
+		dlgs.Warning(applicationName, "The configuration couldn't be written to its original location and was saved to "+path+" instead.")
+	}
+}
+
+// setIcon sets the icon of the tray. The icon file at path replaces the embedded icon, if it can be read. Template icons
+// are only used on macOS, where they adapt to the menu bar. Other platforms render the regular icon
+func setIcon(path string) {
+	data := icon.Data
+	if path != "" {
+		if custom, err := os.ReadFile(path); err != nil {
+			fmt.Printf("Error: %v. Using the default icon\n", err)
+		} else if len(custom) > 0 {
+			data = custom
 		}
 	}
+	if runtime.GOOS == "darwin" {
+		systray.SetTemplateIcon(data, data)
+	} else {
+		systray.SetIcon(data)
+	}
+}
+
+// setTooltip shows the active MIDI channel in the tooltip of the tray icon
+func setTooltip(channel uint8) {
+	systray.SetTooltip(fmt.Sprintf("%v - Channel %v", applicationName, channel))
 }
 
-// initSettings initializes the settings engine Viper. If it doesn't exist it is automatically created using the defaults
-func initSettings() error {
-	for k, v := range configDefaults {
-		viper.SetDefault(k, v)
+// retryWithBackoff calls open until it succeeds or it failed retries times after the first attempt. The delay between two
+// attempts starts with one second and is doubled after each attempt. The error of the last attempt is returned
+func retryWithBackoff(retries int, open func() error) error {
+	delay := time.Second
+	err := open()
+	for i := 0; err != nil && i < retries; i++ {
+		fmt.Printf("Error: %v. Retrying in %v\n", err, delay)
+		time.Sleep(delay)
+		delay *= 2
+		err = open()
 	}
+	return err
+}
 
-	viper.SetConfigName("config")
-	viper.SetConfigType("yaml")
-	viper.AddConfigPath(".")
-	if err := viper.ReadInConfig(); err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			if err = viper.SafeWriteConfig(); err != nil {
-				fmt.Println(err)
-			}
-		} else {
-			fmt.Println(err)
-			return err
+// midiKeywords contains the parts of MIDI port names commonly used for loopMIDI ports, used if MidiDevice isn't found
+var midiKeywords = []string{"shuttle", "loopmidi", "sdr"}
+
+// selectMIDIDevice returns the name of the MIDI device to use. If MidiDevice isn't available, a port matching
+// midiKeywords is used instead. On the first run the user is guided to select or create the loopMIDI port and the
+// selection is stored in the configuration
+func selectMIDIDevice(cfg *Config, devs []string) string {
+	if devices.MatchMIDIDevice(devs, cfg.MidiDevice, cfg.MidiExactMatch) >= 0 {
+		return cfg.MidiDevice
+	}
+
+	name := cfg.MidiDevice
+	if i := devices.MatchMIDIKeywords(devs, midiKeywords); i >= 0 {
+		fmt.Printf("MIDI device %v not found, using %v\n", cfg.MidiDevice, devs[i])
+		name = devs[i]
+	}
+	if !firstRun {
+		return name
+	}
+
+	switch {
+	case len(devs) == 0:
+		dlgs.Info(applicationName, "No MIDI port found. Please install loopMIDI from https://www.tobias-erichsen.de/software/loopmidi.html, "+
+			"create a port named \""+cfg.MidiDevice+"\" and restart ShuttleMidi.")
+		return name
+	case name != cfg.MidiDevice:
+		if ok, _ := dlgs.Question(applicationName, "MIDI port \""+cfg.MidiDevice+"\" not found. Use \""+name+"\" instead?", false); !ok {
+			return cfg.MidiDevice
+		}
+	default:
+		selected, ok, _ := dlgs.List(applicationName, "MIDI port \""+cfg.MidiDevice+"\" not found. Select the loopMIDI port to use "+
+			"or cancel and create a port named \""+cfg.MidiDevice+"\" in loopMIDI:", devs)
+		if !ok {
+			return name
 		}
+		name = selected
 	}
-	return nil
+
+	updateConfig(func(cur *Config) *Config { return cur.withMidiDevice(name) })
+	viper.Set("MidiDevice", name)
+	persistConfig()
+	return name
 }
 
-// startListeners creates and opens the specified MIDI device and starts the event handling goroutine readshuttle.
-// In case the goroutine is already running it is restarted.
-func startListeners(midiname string, se *devices.ShuttlExpress) {
+// nextMIDIDevice returns the device following current in devs. If current isn't part of devs, the first device is returned
+func nextMIDIDevice(devs []string, current string) string {
+	for i, d := range devs {
+		if strings.EqualFold(d, current) {
+			return devs[(i+1)%len(devs)]
+		}
+	}
+	return devs[0]
+}
+
+// stopListeners stops the event handling goroutine readshuttle and closes the MIDI device and all output backends
+func stopListeners() {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	closeListeners()
+}
+
+// closeListeners stops the listeners like stopListeners. The caller must hold listenersMu
+func closeListeners() {
 	if quitch != nil {
 		close(quitch)
 		mcontrol.Close()
+		closeBackends()
+		quitch = nil
+	}
+	closeMidiLog()
+}
+
+// midiController returns the MIDI controller opened last by startListeners, nil before the first start
+func midiController() devices.MidiController {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	return mcontrol
+}
+
+// midiLog is the file the MIDI messages of the active preset are logged to
+var midiLog *os.File
+
+// openMidiLog opens the log file of the active preset in MidiLogDir, e.g. thetis.log. The messages sent without a preset
+// are logged to default.log. nil is returned if MidiLogDir isn't set or the file can't be opened
+func openMidiLog(cfg *Config) io.Writer {
+	if cfg.MidiLogDir == "" {
+		return nil
+	}
+	name := "default"
+	if cfg.Preset != "" {
+		name = strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				return unicode.ToLower(r)
+			}
+			return '-'
+		}, cfg.Preset)
+	}
+	if err := os.MkdirAll(cfg.MidiLogDir, 0755); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(cfg.MidiLogDir, name+".log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return nil
+	}
+	midiLog = f
+	return f
+}
+
+// closeMidiLog closes the log file of the MIDI messages
+func closeMidiLog() {
+	if midiLog != nil {
+		midiLog.Close()
+		midiLog = nil
 	}
+}
+
+// startListeners creates and opens the specified MIDI device and starts the event handling goroutine readshuttle.
+// In case the goroutine is already running it is restarted.
+func startListeners(cfg *Config, midiname string, se *devices.ShuttlExpress) {
+	listenersMu.Lock()
+	err := openListeners(cfg, midiname, se)
+	listenersMu.Unlock()
+	showOpenError(err)
+}
+
+// openListeners starts the listeners like startListeners and returns the error of opening the MIDI device. The caller
+// must hold listenersMu
+func openListeners(cfg *Config, midiname string, se *devices.ShuttlExpress) error {
+	closeListeners()
 	quitch = make(chan struct{})
 
-	mcontrol = devices.NewMIDIController(nil, midiname, 100*time.Millisecond, 0)
+	// reconnect reopens the MIDI device and all backends once the device described by what doesn't respond. current
+	// returns false if the stalled controller was replaced by restarting the listeners meanwhile
+	reconnect := func(what string, current func() bool) {
+		listenersMu.Lock()
+		if !current() {
+			listenersMu.Unlock()
+			return
+		}
+		fmt.Printf("%v doesn't respond, reconnecting\n", what)
+		err := openListeners(cfg, midiname, se)
+		listenersMu.Unlock()
+		showOpenError(err)
+	}
+
+	// the backends use the same options, but don't fall back to another device
+	options := devices.MidiOptions{
+		RampStep:       cfg.WheelRampStep,
+		Offset:         cfg.ControllerOffset,
+		ExactMatch:     cfg.MidiExactMatch,
+		MaxRate:        cfg.MidiMaxRate,
+		SkipDuplicates: cfg.MidiSkipDuplicates,
+		Log:            openMidiLog(cfg),
+	}
+	var mc devices.MidiController
+	mcoptions := options
+	mcoptions.FallbackDevice, mcoptions.FallbackDefault = cfg.MidiFallback, cfg.MidiFallbackDefault
+	mcoptions.OnStall = func() { reconnect("MIDI device "+midiname, func() bool { return mc == mcontrol }) }
+	mc = devices.NewMIDIController(nil, midiname, 100*time.Millisecond, cfg.MidiChannel-1, mcoptions)
+	mcontrol = mc
 	if err := mcontrol.Open(); err != nil {
+		return err
+	}
+	outputs := openBackends(cfg, options, reconnect)
+	outputs[""] = mcontrol
+	go readshuttle(quitch, se, outputs, cfg)
+	return nil
+}
+
+// showOpenError shows the error of opening the MIDI device, if err isn't nil. The dialog blocks, so it must not be
+// shown while holding listenersMu
+func showOpenError(err error) {
+	if err == nil {
+		return
+	}
+	fmt.Printf("Error: %v\n", err)
+	switch {
+	case errors.Is(err, devices.ErrMIDIDriverInit):
+		dlgs.Error(applicationName, "The MIDI driver of the system isn't available.\n"+err.Error())
+	case errors.Is(err, devices.ErrMIDIDeviceBusy):
+		dlgs.Error(applicationName, "The MIDI device is in use by another application. Close it or select another "+
+			"device in the context menu.\n"+err.Error())
+	default:
 		dlgs.Error(applicationName, "Unable to open MIDI device. Please select the correct device in the context menu.\n"+err.Error())
+	}
+}
+
+// openShuttle waits StartupDelay and opens the ShuttlExpress, retrying StartupRetries times. If virtual is set, a virtual
+// ShuttlExpress is created instead
+func openShuttle(cfg *Config, virtual string) (*devices.ShuttlExpress, error) {
+	time.Sleep(cfg.StartupDelay)
+
+	var se *devices.ShuttlExpress
+	if virtual != "" {
+		se = devices.NewVirtualShuttlExpress()
 	} else {
-		go readshuttle(quitch, se, mcontrol)
+		err := retryWithBackoff(cfg.StartupRetries, func() (err error) {
+			se, err = devices.NewFilteredShuttlExpress(cfg.HIDInterface)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
+	se.SetLogReports(cfg.LogHIDReports)
+	se.SetDialFilter(cfg.DialFilter)
+	se.SetDialResume(cfg.DialResume)
+	return se, nil
 }
 
-// onReady is called by systray once the system tray menu can be created. It inializes the menu and opens the ShuttlExpress device
-func onReady() {
-	se, err := devices.NewShuttlExpress()
+// findMIDIDevices returns the names of all MIDI devices. It is retried StartupRetries times until the configured MIDI
+// device is available. The devices found are returned together with the error of the last attempt
+func findMIDIDevices(cfg *Config) ([]string, error) {
+	var devs []string
+	err := retryWithBackoff(cfg.StartupRetries, func() (err error) {
+		devs, err = devices.GetMIDIDevices(nil)
+		if err == nil && devices.MatchMIDIDevice(devs, cfg.MidiDevice, cfg.MidiExactMatch) < 0 {
+			err = devices.ErrMIDIDeviceNotFound
+		}
+		return err
+	})
+	return devs, err
+}
+
+// onReady is called by systray once the system tray menu can be created. It opens the devices and initializes the menu.
+// If the ShuttlExpress can't be opened, the error is shown and the application quits before the menu is created.
+// If virtual is set, a virtual ShuttlExpress fed by the script at this path is used instead of the hardware
+func onReady(cfg *Config, virtual string) {
+	if !claimStart() {
+		fmt.Println("Tray icon created after falling back to the mode without tray menu")
+		return
+	}
+
+	se, err := openShuttle(cfg, virtual)
+	for errors.Is(err, devices.ErrShuttleExpressDeviceBusy) {
+		fmt.Printf("Error: %v\n", err)
+		if ok, _ := dlgs.Question(applicationName, "The ShuttlExpress is in use by another application, e.g. a second "+
+			"ShuttleMidi instance, or access is denied. Close the other application and retry?", false); !ok {
+			break
+		}
+		se, err = openShuttle(cfg, virtual)
+	}
 	if err != nil {
-		if err == devices.ErrShuttleExpressDeviceNotFound {
+		fmt.Printf("Error: %v\n", err)
+		if errors.Is(err, devices.ErrShuttleExpressDeviceNotFound) {
 			dlgs.Error(applicationName, "No ShuttlExpress device connected to this computer. Cannot continue.")
 		} else {
 			dlgs.Error(applicationName, err.Error())
 		}
-		fmt.Printf("Error: %v\n", err)
 		systray.Quit()
+		return
 	}
+	shuttle = se
 
-	devs, err := devices.GetMIDIDevices(nil)
+	devs, err := findMIDIDevices(cfg)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 	}
 
-	systray.SetTemplateIcon(icon.Data, icon.Data)
+	setIcon(cfg.TrayIcon)
 	systray.SetTitle(applicationName)
 	systray.SetTooltip(applicationName)
 
 	menuexit := make(chan struct{})
 
 	mMIDIMenu := systray.AddMenuItem("MIDI Devices", "List of availalbe MIDI devices")
-	midiname := viper.GetString("MidiDevice")
+	midiname := selectMIDIDevice(cfg, devs)
 	mMIDIDevices := make([]*systray.MenuItem, 0, len(devs))
-	for _, v := range devs {
-		mMIDIDevice := mMIDIMenu.AddSubMenuItemCheckbox(v, "", strings.Contains(v, midiname))
+	selected := devices.MatchMIDIDevice(devs, midiname, cfg.MidiExactMatch)
+	for i, v := range devs {
+		mMIDIDevice := mMIDIMenu.AddSubMenuItemCheckbox(v, "", i == selected)
 		mMIDIDevices = append(mMIDIDevices, mMIDIDevice)
 		title := v
 		go func() {
@@ -174,10 +436,11 @@ func onReady() {
 						v.Uncheck()
 					}
 					mMIDIDevice.Check()
+					cfg := updateConfig(func(cur *Config) *Config { return cur.withMidiDevice(title) })
 					viper.Set("MidiDevice", title)
-					fmt.Println(viper.GetString("MidiDevice"))
-					viper.WriteConfig()
-					startListeners(title, se)
+					fmt.Println(title)
+					persistConfig()
+					startListeners(cfg, title, se)
 				case <-menuexit:
 					return
 				}
@@ -185,29 +448,273 @@ func onReady() {
 		}()
 	}
 
+	// checkPort checks the MIDI device actually opened, which differs from the configured device if a fallback was used
+	checkPort := func() {
+		if port := midiController().Port(); port != "" {
+			for i, v := range devs {
+				if v == port {
+					mMIDIDevices[i].Check()
+				} else {
+					mMIDIDevices[i].Uncheck()
+				}
+			}
+		}
+	}
+	cycleDevice = func() {
+		var next string
+		cfg := updateConfig(func(cur *Config) *Config {
+			next = nextMIDIDevice(cur.DeviceCycle.Devices, cur.MidiDevice)
+			return cur.withMidiDevice(next)
+		})
+		fmt.Printf("Switching to MIDI device %v\n", next)
+		startListeners(cfg, next, se)
+		checkPort()
+	}
+
+	mReconnect := systray.AddMenuItem("Reconnect MIDI", "Close and reopen the selected MIDI device")
+	go func() {
+		for {
+			select {
+			case <-mReconnect.ClickedCh:
+				cfg := currentConfig()
+				fmt.Printf("Reconnecting to %v\n", cfg.MidiDevice)
+				startListeners(cfg, cfg.MidiDevice, se)
+			case <-menuexit:
+				return
+			}
+		}
+	}()
+
+	mSettings := systray.AddMenuItem("Settings...", "Select the MIDI device, the MIDI channel and the mappings")
+	mImport := systray.AddMenuItem("Import Mappings...", "Import the mappings from a YAML or JSON file")
+	mExport := systray.AddMenuItem("Export Mappings...", "Export the mappings to a YAML or JSON file")
+	mPreset := systray.AddMenuItem("Write Coarse/Fine Template...", "Write a mappings template using the wheel for coarse and the dial for fine tuning")
+	mPresets := systray.AddMenuItem("Presets", "Replace the mappings by a preset for a program")
+	for _, p := range presets {
+		mProgram := mPresets.AddSubMenuItem(p.Name, "")
+		p := p
+		go func() {
+			for {
+				select {
+				case <-mProgram.ClickedCh:
+					if err := selectPreset(p.Name, se); err != nil {
+						dlgs.Error(applicationName, err.Error())
+					}
+				case <-menuexit:
+					return
+				}
+			}
+		}()
+	}
+	mCalibrate := systray.AddMenuItem("Calibrate Wheel...", "Record the wheel positions at both extremes and adjust the wheel settings")
+	mLearn := systray.AddMenuItemCheckbox("Learn Mappings", "Bind the next controller or note received from the host to every control actuated", false)
+	go func() {
+		for {
+			select {
+			case <-mSettings.ClickedCh:
+				ok, err := editSettings(currentConfig(), devs)
+				if err != nil {
+					dlgs.Error(applicationName, "Unable to save the settings.\n"+err.Error())
+				}
+				if !ok {
+					continue
+				}
+				newcfg, err := loadConfig()
+				if err != nil {
+					dlgs.Error(applicationName, "Invalid configuration.\n"+err.Error())
+					continue
+				}
+				setConfig(newcfg)
+				startListeners(newcfg, newcfg.MidiDevice, se)
+				checkPort()
+			case <-mImport.ClickedCh:
+				path, ok, _ := dlgs.File("Import Mappings", "*.yaml *.yml *.json", false)
+				if !ok {
+					continue
+				}
+				conflicts, err := importMappings(path)
+				if err != nil {
+					dlgs.Error(applicationName, "Unable to import mappings.\n"+err.Error())
+					continue
+				}
+				if len(conflicts) > 0 {
+					dlgs.Warning(applicationName, "Mappings imported with conflicts:\n"+strings.Join(conflicts, "\n"))
+				}
+				cfg, _ := reloadConfig()
+				startListeners(cfg, cfg.MidiDevice, se)
+			case <-mExport.ClickedCh:
+				path, ok, _ := dlgs.Entry(applicationName, "File to export the mappings to (.yaml or .json)", "mappings.yaml")
+				if !ok {
+					continue
+				}
+				if err := exportMappings(path); err != nil {
+					dlgs.Error(applicationName, "Unable to export mappings.\n"+err.Error())
+				}
+			case <-mPreset.ClickedCh:
+				path, ok, _ := dlgs.Entry(applicationName, "File to write the template to (.yaml or .json). Import it afterwards to use it", "coarse-fine.yaml")
+				if !ok {
+					continue
+				}
+				if err := writeCoarseFinePreset(path); err != nil {
+					dlgs.Error(applicationName, "Unable to write template.\n"+err.Error())
+				}
+			case <-mCalibrate.ClickedCh:
+				// no MIDI messages are sent while the wheel is moved during calibration
+				stopListeners()
+				if err := calibrateWheel(se); err != nil && err != errCalibrationCanceled {
+					dlgs.Error(applicationName, "Unable to calibrate the wheel.\n"+err.Error())
+				} else if err == nil {
+					reloadConfig()
+				}
+				cfg := currentConfig()
+				startListeners(cfg, cfg.MidiDevice, se)
+			case <-mLearn.ClickedCh:
+				if mLearn.Checked() {
+					atomic.StoreInt32(&learning, 0)
+					mLearn.Uncheck()
+				} else {
+					atomic.StoreInt32(&learning, 1)
+					mLearn.Check()
+				}
+			case <-menuexit:
+				return
+			}
+		}
+	}()
+
 	systray.AddSeparator()
 
 	mQuitItem := systray.AddMenuItem("Quit", "Quit the whole app")
 	go func() {
-		<-mQuitItem.ClickedCh
-		close(quitch)
+		for range mQuitItem.ClickedCh {
+			if !currentConfig().QuitConfirm {
+				break
+			}
+			if ok, err := dlgs.Question(applicationName, "Quit ShuttleMidi? No MIDI messages are sent afterwards.", true); ok || err != nil {
+				break
+			}
+		}
+		stopListeners()
 		close(menuexit)
 		systray.Quit()
 	}()
 
 	// Instantiate MIDI Controller
-	startListeners(midiname, se)
+	startListeners(currentConfig(), midiname, se)
+
+	checkPort()
+	startPresetSwitch(cfg, se)
+
+	if virtual != "" {
+		go runVirtualInput(se, virtual)
+	}
+	if cfg.SelfTest {
+		go selfTest(se, midiController(), cfg.SelfTestTimeout)
+	}
 }
 
-// onExit is called by systray on exit and closes the MidiController
-func onExit() {
-	if mcontrol != nil {
-		mcontrol.Close()
+// runHeadless opens the devices and starts the event handling without the tray menu. It is used if systray fails to
+// create the tray icon, e.g. if no shell is available in the login session
+func runHeadless(cfg *Config, virtual string) {
+	se, err := openShuttle(cfg, virtual)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	shuttle = se
+
+	devs, err := findMIDIDevices(cfg)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	midiname := selectMIDIDevice(cfg, devs)
+	startListeners(currentConfig(), midiname, se)
+	startPresetSwitch(cfg, se)
+
+	if virtual != "" {
+		go runVirtualInput(se, virtual)
 	}
 }
 
+// onExit is called by systray on exit and closes the MidiController, all output backends and the PresetSwitch input
+func onExit() {
+	stopListeners()
+	stopPresetSwitch()
+}
+
 func main() {
-	initSettings()
+	importFile := flag.String("import-mappings", "", "import the mappings from the given YAML or JSON file and exit")
+	exportFile := flag.String("export-mappings", "", "export the mappings to the given YAML or JSON file and exit")
+	configFile := flag.String("config", "", "use the given configuration file instead of config.yaml in the user config directory")
+	configFormat := flag.String("config-format", "yaml", "format of a newly created configuration file in the user config directory (yaml, json or toml)")
+	logHID := flag.Bool("log-hid", false, "log the raw bytes of every HID report of the ShuttlExpress")
+	trayIcon := flag.String("icon", "", "use the given icon file (.ico on Windows, .png otherwise) for the tray")
+	virtualFile := flag.String("virtual", "", "use a virtual ShuttlExpress fed by the events of the given script file (- for standard input)")
+	flag.Parse()
+
+	if !validConfigFormat(*configFormat) {
+		fmt.Printf("Error: unsupported configuration format %v\n", *configFormat)
+		return
+	}
+	if err := initSettings(*configFile, *configFormat); err != nil {
+		// any setting saved later would overwrite the configuration with the defaults
+		dlgs.Error(applicationName, "Unable to read the configuration.\n"+err.Error())
+		return
+	}
+
+	if *exportFile != "" {
+		if err := exportMappings(*exportFile); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		return
+	}
+	if *importFile != "" {
+		conflicts, err := importMappings(*importFile)
+		for _, c := range conflicts {
+			fmt.Printf("Warning: %v\n", c)
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		return
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		dlgs.Error(applicationName, "Invalid configuration.\n"+err.Error())
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
 
-	systray.Run(onReady, onExit)
+	if warnings := rangeWarnings(cfg); len(warnings) > 0 {
+		for _, w := range warnings {
+			fmt.Printf("Warning: %v\n", w)
+		}
+		dlgs.Warning(applicationName, "The host doesn't listen on some controllers:\n"+strings.Join(warnings, "\n"))
+	}
+
+	cfg.LogHIDReports = cfg.LogHIDReports || *logHID
+	if *trayIcon != "" {
+		cfg.TrayIcon = *trayIcon
+	}
+	setConfig(cfg)
+
+	if cfg.API.Enabled {
+		startAPI(cfg.API, midiController, func() *devices.ShuttlExpress { return shuttle },
+			func() string { return currentConfig().Preset }, func(name string) error {
+				if shuttle == nil {
+					return devices.ErrShuttleExpressDeviceNotOpened
+				}
+				return selectPreset(name, shuttle)
+			})
+	}
+
+	go func() {
+		time.Sleep(trayTimeout)
+		if claimStart() {
+			fmt.Println("Unable to create the tray icon, running without tray menu")
+			runHeadless(cfg, *virtualFile)
+		}
+	}()
+	systray.Run(func() { onReady(cfg, *virtualFile) }, onExit)
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dg1psi/shuttlemidi/devices"
+	"github.com/dg1psi/shuttlemidi/mapping"
+	"github.com/spf13/viper"
+)
+
+// mappingDefaults contain the default mapping of each control, written to the configuration file
+var mappingDefaults = map[string]interface{}{
+	mapping.ControlWheelUp:   map[string]interface{}{"Name": "Tune Up", "Controller": 0},
+	mapping.ControlWheelDown: map[string]interface{}{"Name": "Tune Down", "Controller": 1},
+	mapping.ControlDial:      map[string]interface{}{"Name": "Dial", "Controller": 2},
+	mapping.ControlButton1:   map[string]interface{}{"Name": "Button 1", "Controller": 3},
+	mapping.ControlButton2:   map[string]interface{}{"Name": "Button 2", "Controller": 4},
+	mapping.ControlButton3:   map[string]interface{}{"Name": "Button 3", "Controller": 5},
+	mapping.ControlButton4:   map[string]interface{}{"Name": "Button 4", "Controller": 6},
+	mapping.ControlButton5:   map[string]interface{}{"Name": "Button 5", "Controller": 7},
+}
+
+// mappingConflicts returns a description of all controllers used by more than one mapping
+func mappingConflicts(mappings map[string]mapping.Mapping) []string {
+	users := make(map[uint8][]string)
+	for k, m := range mappings {
+		users[m.Controller] = append(users[m.Controller], k)
+	}
+
+	var conflicts []string
+	for c, u := range users {
+		if len(u) > 1 {
+			sort.Strings(u)
+			conflicts = append(conflicts, fmt.Sprintf("Controller %v is used by %v", c, strings.Join(u, ", ")))
+		}
+	}
+	sort.Strings(conflicts)
+	return conflicts
+}
+
+// rangeWarnings returns a description of all mappings sending a controller number outside of ControllerRange after
+// adding ControllerOffset. Note and program mappings don't send a controller and are skipped
+func rangeWarnings(cfg *Config) []string {
+	r := cfg.ControllerRange
+	if r.Max == 0 {
+		return nil
+	}
+	var warnings []string
+	for k, m := range cfg.Mappings {
+		if strings.EqualFold(m.Type, mapping.TypeNote) || strings.EqualFold(m.Type, mapping.TypeProgram) {
+			continue
+		}
+		if c := int(m.Controller) + cfg.ControllerOffset; c < int(r.Min) || c > int(r.Max) {
+			warnings = append(warnings, fmt.Sprintf("Controller %v of %v is outside of the range %v to %v of the host", c, k, r.Min, r.Max))
+		}
+	}
+	sort.Strings(warnings)
+	return warnings
+}
+
+// exportMappings writes the mappings section of the current configuration to a standalone file. The file format is
+// selected by the file extension (yaml, yml or json)
+func exportMappings(path string) error {
+	v := viper.New()
+	v.Set("Mappings", viper.AllSettings()["mappings"])
+	return v.WriteConfigAs(path)
+}
+
+// importMappings reads the mappings section from a standalone file and merges it into the current configuration,
+// which is written afterwards. The mappings are validated before they are applied. Controllers used by more than one
+// mapping and controllers outside of ControllerRange are returned as conflicts
+func importMappings(path string) (conflicts []string, err error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	raw := v.GetStringMap("Mappings")
+	if len(raw) == 0 {
+		return nil, errors.New("no mappings found in " + path)
+	}
+	var imported map[string]mapping.Mapping
+	if err := v.UnmarshalKey("Mappings", &imported); err != nil {
+		return nil, err
+	}
+	mappings, unknown := mapping.NormalizeMappings(imported)
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown controls: %v", strings.Join(unknown, ", "))
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	for k, m := range mappings {
+		cfg.Mappings[k] = m
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	for k, m := range raw {
+		viper.Set("Mappings."+k, m)
+	}
+	viper.Set("Preset", "")
+	_, err = saveConfig()
+	return append(mappingConflicts(cfg.Mappings), rangeWarnings(cfg)...), err
+}
+
+// learnMapping binds the mapping of control to the controller or note of cmd, creating the mapping if necessary, and
+// saves the configuration. The new active configuration, the conflicts and the controllers outside of ControllerRange
+// of the resulting mappings are returned. The configuration is kept if the mapping is invalid, e.g. a note for the wheel
+func learnMapping(control string, cmd devices.Command) (*Config, []string, error) {
+	var m mapping.Mapping
+	var err error
+	cfg := updateConfig(func(cur *Config) *Config {
+		if m, err = learnedMapping(cur.Mappings[control], control, cmd); err != nil {
+			return cur
+		}
+		mappings := make(map[string]mapping.Mapping, len(cur.Mappings)+1)
+		for k, v := range cur.Mappings {
+			mappings[k] = v
+		}
+		mappings[control] = m
+		c := *cur
+		c.Mappings = mappings
+		return &c
+	})
+
+	if err != nil {
+		return cfg, nil, err
+	}
+
+	viper.Set("Mappings."+control+".Name", m.Name)
+	viper.Set("Mappings."+control+".Type", m.Type)
+	viper.Set("Mappings."+control+".Controller", m.Controller)
+	viper.Set("Mappings."+control+".Note", m.Note)
+	viper.Set("Preset", "")
+	_, err = saveConfig()
+	return cfg, append(mappingConflicts(cfg.Mappings), rangeWarnings(cfg)...), err
+}
+
+// coarseFinePreset contains the mappings written by writeCoarseFinePreset. The wheel is used for coarse tuning with the
+// full value range, the dial for fine tuning with one step per detent in two's complement encoding
+var coarseFinePreset = map[string]interface{}{
+	mapping.ControlWheelUp:   map[string]interface{}{"Name": "Coarse Tune Up", "Controller": 0, "Step": 18},
+	mapping.ControlWheelDown: map[string]interface{}{"Name": "Coarse Tune Down", "Controller": 1, "Step": 18},
+	mapping.ControlDial:      map[string]interface{}{"Name": "Fine Tune", "Controller": 2, "Step": 1, "Encoding": mapping.EncodingTwosComplement},
+}
+
+// writeCoarseFinePreset writes a mappings template using the wheel for coarse and the dial for fine tuning. The
+// template can be imported with importMappings
+func writeCoarseFinePreset(path string) error {
+	v := viper.New()
+	v.Set("Mappings", coarseFinePreset)
+	return v.WriteConfigAs(path)
+}
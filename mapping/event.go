@@ -0,0 +1,86 @@
+package mapping
+
+import (
+	"fmt"
+
+	"github.com/dg1psi/shuttlemidi/devices"
+)
+
+// Event enumerates the actions the Mapper dispatches to its handlers
+type Event uint8
+
+const (
+	WheelMoved           Event = iota // the wheel position changed
+	WheelIdle                         // no wheel event was received for WheelIdleTimeout
+	WheelReturnDue                    // the wheel didn't reach center within WheelReturnTimeout after leaving full deflection
+	WheelStepDue                      // the steps accumulated by the wheel with WheelStepRate are due
+	DialClockwise                     // the dial was turned by one detent clockwise
+	DialCounterclockwise              // the dial was turned by one detent counterclockwise
+	DialIdle                          // the dial wasn't turned within DialRepeatWindow
+	ButtonPressed                     // a button was pressed
+	ButtonReleased                    // a button was released
+	ButtonReleaseDue                  // the release delayed by MinHold is due
+	NoteStrikeDue                     // the button of a note with VelocityTime is still held after VelocityTime
+	GestureDetected                   // a gesture was detected
+	DeviceError                       // the ShuttlExpress was disconnected
+)
+
+// eventNames contains the names of all events
+var eventNames = []string{"WheelMoved", "WheelIdle", "WheelReturnDue", "WheelStepDue", "DialClockwise", "DialCounterclockwise", "DialIdle", "ButtonPressed",
+	"ButtonReleased", "ButtonReleaseDue", "NoteStrikeDue", "GestureDetected", "DeviceError"}
+
+// String returns the name of the event
+func (e Event) String() string {
+	if int(e) < len(eventNames) {
+		return eventNames[e]
+	}
+	return fmt.Sprintf("Event(%d)", uint8(e))
+}
+
+// dispatch contains an Event together with its parameters, which is passed to the handler of the event
+type dispatch struct {
+	Event   Event
+	Control string // identifier of the button of the button events
+	Value   int8   // wheel position of WheelMoved
+	Gesture devices.Gesture
+	Err     error
+}
+
+// handler processes a dispatched event and sends the resulting commands
+type handler func(d dispatch)
+
+// control returns the identifier of the mapping actuated by a WheelMoved, Dial or ButtonPressed event. reverse swaps
+// the wheel directions. An empty string is returned for all other events and the wheel returning to center
+func (d dispatch) control(reverse bool) string {
+	switch d.Event {
+	case WheelMoved:
+		if reverse {
+			d.Value = -d.Value
+		}
+		if d.Value > 0 {
+			return ControlWheelUp
+		} else if d.Value < 0 {
+			return ControlWheelDown
+		}
+	case DialClockwise, DialCounterclockwise:
+		return ControlDial
+	case ButtonPressed:
+		return d.Control
+	}
+	return ""
+}
+
+// deviceDispatch converts a ShuttlExpress event into the dispatched event
+func deviceDispatch(e devices.Event) dispatch {
+	switch {
+	case e.Control == devices.Wheel:
+		return dispatch{Event: WheelMoved, Value: int8(e.Value)}
+	case e.Control == devices.Dial && e.Value > 0:
+		return dispatch{Event: DialClockwise}
+	case e.Control == devices.Dial:
+		return dispatch{Event: DialCounterclockwise}
+	case e.Value != 0:
+		return dispatch{Event: ButtonPressed, Control: e.Control.String()}
+	}
+	return dispatch{Event: ButtonReleased, Control: e.Control.String()}
+}
@@ -0,0 +1,75 @@
+package mapping_test
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dg1psi/shuttlemidi/devices"
+	"github.com/dg1psi/shuttlemidi/mapping"
+	"gitlab.com/gomidi/midi/testdrv"
+)
+
+func ExampleNewMapper() {
+	// the test driver passes every message written to its output port to the listener of its input port
+	drv := testdrv.New("example")
+	ins, _ := drv.Ins()
+	ins[0].Open()
+	received := make(chan []byte, 16)
+	ins[0].SetListener(func(b []byte, _ int64) { received <- append([]byte(nil), b...) })
+
+	out := devices.NewMIDIController(drv, "example", 100*time.Millisecond, 0, devices.MidiOptions{})
+	if err := out.Open(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer out.Close()
+
+	mappings := map[string]mapping.Mapping{
+		mapping.ControlWheelUp:   {Name: "Tune Up", Controller: 0},
+		mapping.ControlWheelDown: {Name: "Tune Down", Controller: 1},
+		mapping.ControlDial:      {Name: "Dial", Controller: 2, Encoding: mapping.EncodingBinaryOffset},
+		mapping.ControlButton1:   {Name: "Record", Controller: 20},
+		mapping.ControlButton2:   {Name: "Pad", Type: mapping.TypeNote, Note: 36, Velocity: 100, Channel: 10},
+		mapping.ControlButton3:   {Name: "Button 3", Controller: 5},
+		mapping.ControlButton4:   {Name: "Button 4", Controller: 6},
+		mapping.ControlButton5:   {Name: "Button 5", Controller: 7},
+	}
+	// OnChannel is called once Run receives the events of the ShuttlExpress
+	ready := make(chan struct{}, 1)
+	mapper, err := mapping.NewMapper(mappings, mapping.Options{
+		Channel:   1,
+		WheelMax:  7,
+		OnChannel: func(uint8) { ready <- struct{}{} },
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	se := devices.NewVirtualShuttlExpress()
+	quitch := make(chan struct{})
+	defer close(quitch)
+	go mapper.Run(quitch, se, map[string]devices.MidiController{"": out})
+	<-ready
+
+	// the note off of the pad is sent as note on with velocity 0
+	se.Simulate(devices.Button1, 1)
+	se.Simulate(devices.Button1, 0)
+	se.Simulate(devices.Button2, 1)
+	se.Simulate(devices.Button2, 0)
+	se.Simulate(devices.Dial, 1)
+	for {
+		select {
+		case msg := <-received:
+			fmt.Printf("% X\n", msg)
+		case <-time.After(100 * time.Millisecond):
+			return
+		}
+	}
+	// Output:
+	// B0 14 7F
+	// B0 14 00
+	// 99 24 64
+	// 99 24 00
+	// B0 02 41
+}
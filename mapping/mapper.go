@@ -0,0 +1,1021 @@
+package mapping
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/dg1psi/shuttlemidi/devices"
+)
+
+const (
+	wheelStepInterval = 20 * time.Millisecond // interval of sending the steps accumulated with WheelStepRate
+
+	defaultWheelMax             = 7                      // wheel position at full deflection of the ShuttlExpress
+	defaultGestureHoldTime      = 500 * time.Millisecond // default of GestureHoldTime
+	defaultGestureDoubleTapTime = 300 * time.Millisecond // default of GestureDoubleTapTime
+	defaultGestureChordWindow   = 100 * time.Millisecond // default of GestureChordWindow
+
+	clockTaps      = 4               // maximum number of taps averaged for the tempo of the ClockButton
+	clockTapWindow = 2 * time.Second // maximum time between two taps of the same tempo
+)
+
+// WheelBand maps the wheel positions above the Max of the previous band up to its own Max to the Up and Down mappings
+type WheelBand struct {
+	Max  int8
+	Up   Mapping
+	Down Mapping
+}
+
+// bandControl returns the identifier of the mapping of the WheelBand with the given index in the direction of position
+func bandControl(index int, position int8) string {
+	if position < 0 {
+		return fmt.Sprintf("WheelBand%vDown", index+1)
+	}
+	return fmt.Sprintf("WheelBand%vUp", index+1)
+}
+
+// State contains the runtime state of a Mapper, which is restored by passing it to the next Mapper
+type State struct {
+	// Channel is the MIDI channel (1-16) selected by the ChannelToggleButton, 0 if it wasn't toggled
+	Channel uint8
+	// Counters contains the current values of the counter buttons pressed
+	Counters map[string]uint8
+}
+
+// Options contains the settings of a Mapper
+type Options struct {
+	// Channel is the MIDI channel (1-16) the MIDI controller is opened with (default 1)
+	Channel uint8
+	// ChannelToggleButton is the button toggling between the two ChannelToggleChannels. Empty disables the toggle
+	ChannelToggleButton   string
+	ChannelToggleChannels []uint8
+	// PanicButton is the button stopping all commands and sending All Controllers Off and All Notes Off to all outputs,
+	// instead of its mapping. Empty disables it
+	PanicButton string
+	// ClockButton is the button setting the tempo of the MIDI Clock sent to the default output by tapping. Holding it for
+	// GestureHoldTime stops the clock. Empty disables it
+	ClockButton string
+	// DeviceCycleButton is the button calling OnDeviceCycle when pressed. Empty disables it
+	DeviceCycleButton string
+	// OnDeviceCycle is called in a new goroutine, as it usually restarts the Mapper with the next MIDI device
+	OnDeviceCycle func()
+	// WheelMax is the wheel position reported at full deflection (1-7, default 7)
+	WheelMax int8
+	// WheelReverse swaps the direction of the wheel
+	WheelReverse bool
+	// WheelCenterWindow treats all wheel positions up to the given distance from the center as center position
+	WheelCenterWindow int8
+	// WheelPositiveInvert and WheelNegativeInvert invert the values of positive and negative wheel positions
+	WheelPositiveInvert bool
+	WheelNegativeInvert bool
+	// WheelFineThreshold is the maximum wheel position using the WheelUpFine and WheelDownFine mappings. 0 disables them
+	WheelFineThreshold int8
+	// WheelBands split the wheel positions into bands with their own mappings, replacing WheelUp, WheelDown and the
+	// fine mappings. Positions above the last band use the regular mappings
+	WheelBands []WheelBand
+	// WheelStepRate selects the accumulator mode of the wheel with the given number of steps per second and wheel
+	// position. The steps accumulated over time are sent as discrete WheelUp or WheelDown commands with their Value,
+	// instead of repeating a value proportional to the position. 0 disables it
+	WheelStepRate float64
+	// WheelStopValue is the controller value sent when the wheel returns to center. -1 only stops the repeated messages
+	WheelStopValue int
+	// WheelStopActive only sends WheelStopValue to the tune mapping which was active before the wheel returned to center
+	WheelStopActive bool
+	// WheelIdleTimeout stops the wheel if no wheel event is received for the given duration. 0 disables the timeout
+	WheelIdleTimeout time.Duration
+	// WheelReturnTimeout stops the wheel if it leaves full deflection towards center and no further wheel event is
+	// received for the given duration, as the spring returns the released wheel to center. Positions reported afterwards
+	// on the way back are ignored. 0 disables it
+	WheelReturnTimeout time.Duration
+	// DialRepeatWindow repeats the dial command while the dial keeps moving in one direction with less than the given
+	// duration between two detents. 0 disables repeating
+	DialRepeatWindow time.Duration
+	// GestureHoldTime, GestureDoubleTapTime and GestureChordWindow configure the detection of the gesture actions
+	// (default 500ms, 300ms and 100ms)
+	GestureHoldTime      time.Duration
+	GestureDoubleTapTime time.Duration
+	GestureChordWindow   time.Duration
+	// OnEvent is called with every event of the ShuttlExpress and OnSend with every command sent and the name of the
+	// output backend, empty for the default MIDI device. They are called by Run and must not block. Both may be nil
+	OnEvent func(e devices.Event)
+	OnSend  func(output string, cmd devices.Command)
+	// OnControl is called with the identifier of the mapping, e.g. Button1 or WheelUp, whenever a control of the
+	// ShuttlExpress is actuated. It is called by Run and must not block. It may be nil
+	OnControl func(control string)
+	// State is the runtime state restored when Run starts. A Channel which isn't one of the ChannelToggleChannels is
+	// ignored
+	State State
+	// OnState is called with the runtime state after each change of it, e.g. to persist it. It may be nil
+	OnState func(state State)
+	// OnChannel is called with the active MIDI channel when Run starts and after each toggle. It may be nil
+	OnChannel func(channel uint8)
+	// Pipelines are independent mappers with their own outputs, each handling a subset of the controls. Only the
+	// Pipelines of the Mapper started by Run are used
+	Pipelines []Pipeline
+}
+
+// Mapper sends the MIDI commands of the mappings for the events of a ShuttlExpress
+type Mapper struct {
+	Mappings map[string]Mapping
+	Options
+}
+
+// NewMapper creates a Mapper for the mappings, which use the control identifiers as keys. Options left at zero are set
+// to their defaults. An error is returned if a mapping or an option is invalid. Controls without a mapping are ignored
+func NewMapper(mappings map[string]Mapping, options Options) (*Mapper, error) {
+	if options.Channel == 0 {
+		options.Channel = 1
+	}
+	if options.WheelMax == 0 {
+		options.WheelMax = defaultWheelMax
+	}
+	if options.GestureHoldTime == 0 {
+		options.GestureHoldTime = defaultGestureHoldTime
+	}
+	if options.GestureDoubleTapTime == 0 {
+		options.GestureDoubleTapTime = defaultGestureDoubleTapTime
+	}
+	if options.GestureChordWindow == 0 {
+		options.GestureChordWindow = defaultGestureChordWindow
+	}
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	for c, m := range mappings {
+		if err := m.Validate(c); err != nil {
+			return nil, err
+		}
+	}
+	return &Mapper{Mappings: mappings, Options: options}, nil
+}
+
+// validate checks the ranges of the options and the buttons of the button actions
+func (o *Options) validate() error {
+	if o.Channel > 16 {
+		return fmt.Errorf("channel %v is outside of the range 1 to 16", o.Channel)
+	}
+	if o.WheelMax < 1 || o.WheelMax > defaultWheelMax {
+		return fmt.Errorf("WheelMax %v is outside of the range 1 to %v", o.WheelMax, defaultWheelMax)
+	}
+	if o.WheelCenterWindow < 0 || o.WheelCenterWindow >= o.WheelMax || o.WheelFineThreshold < 0 || o.WheelFineThreshold >= o.WheelMax {
+		return fmt.Errorf("WheelCenterWindow and WheelFineThreshold must be in the range 0 to %v", o.WheelMax-1)
+	}
+	for i, b := range o.WheelBands {
+		if b.Max < 1 || b.Max > o.WheelMax || (i > 0 && b.Max <= o.WheelBands[i-1].Max) {
+			return fmt.Errorf("Max %v of WheelBands entry %v must be between 1 and %v and above the previous band", b.Max, i+1, o.WheelMax)
+		}
+		if err := b.Up.Validate(bandControl(i, 1)); err != nil {
+			return err
+		}
+		if err := b.Down.Validate(bandControl(i, -1)); err != nil {
+			return err
+		}
+	}
+	if o.WheelStepRate < 0 || o.WheelStopValue < -1 || o.WheelStopValue > 127 {
+		return errors.New("WheelStepRate must not be negative and WheelStopValue must be in the range -1 to 127")
+	}
+	if o.WheelIdleTimeout < 0 || o.WheelReturnTimeout < 0 || o.DialRepeatWindow < 0 {
+		return errors.New("WheelIdleTimeout, WheelReturnTimeout and DialRepeatWindow must not be negative")
+	}
+	if o.GestureHoldTime < 0 || o.GestureDoubleTapTime < 0 || o.GestureChordWindow < 0 {
+		return errors.New("GestureHoldTime, GestureDoubleTapTime and GestureChordWindow must not be negative")
+	}
+	for _, b := range []string{o.ChannelToggleButton, o.PanicButton, o.ClockButton, o.DeviceCycleButton} {
+		if b != "" && !isButton(b) {
+			return fmt.Errorf("unknown button %v", b)
+		}
+	}
+	if o.ChannelToggleButton != "" {
+		if len(o.ChannelToggleChannels) != 2 {
+			return errors.New("ChannelToggleChannels must contain two channels")
+		}
+		for _, ch := range o.ChannelToggleChannels {
+			if ch < 1 || ch > 16 {
+				return fmt.Errorf("ChannelToggleChannels channel %v is outside of the range 1 to 16", ch)
+			}
+		}
+	}
+	return nil
+}
+
+// isButton returns true if control is the identifier of a button
+func isButton(control string) bool {
+	for _, b := range ButtonControls {
+		if b == control {
+			return true
+		}
+	}
+	return false
+}
+
+// setChannel notifies OnChannel about the active MIDI channel
+func (mp *Mapper) setChannel(channel uint8) {
+	if mp.OnChannel != nil {
+		mp.OnChannel(channel)
+	}
+}
+
+// Run handles all ShuttlExpress events and sends out the MIDI messages using the mappings. Each mapping is sent through
+// the output it names by its Backend, the output registered with an empty name is used by default. If no wheel event is
+// received for WheelIdleTimeout while the wheel is not centered, the wheel is considered to be back in center position.
+// All control changes, timers and gestures are converted into an Event, which is dispatched to its handler. The events
+// of the controls handled by Pipelines are passed to their mappers instead.
+// Run blocks until the quitch channel is closed
+func (mp *Mapper) Run(quitch chan struct{}, se *devices.ShuttlExpress, outputs map[string]devices.MidiController) {
+	// all control changes are received as typed events, the control specific channels aren't used
+	se.Wheel_position = nil
+	se.Dial_direction = nil
+	se.Button1_pressed = nil
+	se.Button2_pressed = nil
+	se.Button3_pressed = nil
+	se.Button4_pressed = nil
+	se.Button5_pressed = nil
+	// the next Mapper subscribes when this one is stopped, the device keeps being read in between
+	events, errors := se.Subscribe(quitch)
+
+	routes, errs := startPipelines(quitch, mp.Pipelines)
+	mp.run(quitch, events, errors, outputs, routes, errs)
+}
+
+// run handles the events and errors of the ShuttlExpress until quitch is closed. The events of the controls in routes
+// are passed on to the pipeline instead and errors are passed on to all pipelines
+func (mp *Mapper) run(quitch chan struct{}, events <-chan devices.Event, errors <-chan error, outputs map[string]devices.MidiController,
+	routes map[devices.Control]chan devices.Event, errs []chan error) {
+	// mappings contains the mappings of the WheelBands in addition to the configured ones
+	mappings := make(map[string]Mapping, len(mp.Mappings)+2*len(mp.WheelBands))
+	for k, m := range mp.Mappings {
+		mappings[k] = m
+	}
+	for i, b := range mp.WheelBands {
+		mappings[bandControl(i, 1)], mappings[bandControl(i, -1)] = b.Up, b.Down
+	}
+	mc := outputs[""]
+
+	// send sends the command of the mapping through the backend selected by the mapping
+	send := func(m Mapping, value uint8, repeat bool) {
+		cmd := m.Command(value, repeat)
+		for i, b := range append([]string{m.Backend}, m.Also...) {
+			out, ok := outputs[strings.ToLower(b)]
+			if !ok {
+				if i > 0 {
+					continue // additional backends which couldn't be opened are skipped
+				}
+				out, b = mc, ""
+			}
+			out.Send(cmd)
+			if mp.OnSend != nil {
+				mp.OnSend(strings.ToLower(b), cmd)
+			}
+		}
+	}
+
+	// the gestures are only detected if a gesture mapping is configured. The events are forwarded to the detector
+	var gestureEvents chan devices.Event
+	var gestures chan devices.Gesture
+	for _, c := range append(GestureControls(), ControlBank) {
+		if _, ok := mappings[c]; ok {
+			gestureEvents = make(chan devices.Event)
+			gd := devices.NewGestureDetector(gestureEvents, devices.GestureOptions{
+				HoldTime:      mp.GestureHoldTime,
+				DoubleTapTime: mp.GestureDoubleTapTime,
+				ChordWindow:   mp.GestureChordWindow,
+				WheelMax:      int(mp.WheelMax),
+			})
+			defer gd.Stop()
+			gestures = gd.Gestures
+			break
+		}
+	}
+
+	idle := time.NewTimer(time.Hour)
+	defer idle.Stop()
+	stopIdle := func() { stopTimer(idle) }
+	stopIdle()
+	// returning is the timer of WheelReturnTimeout, returned the wheel position at which it stopped the wheel and
+	// wheelpos the last wheel position
+	returning := time.NewTimer(time.Hour)
+	defer returning.Stop()
+	stopTimer(returning)
+	var returned, wheelpos int8
+
+	// dialtimer stops the repeated dial command if the dial isn't moved within DialRepeatWindow
+	dialtimer := time.NewTimer(time.Hour)
+	defer dialtimer.Stop()
+	stopTimer(dialtimer)
+	var lastdial time.Time
+	var lastdir int8
+
+	// dialcount counts the detents in direction dialdir since the last dial command
+	dialcount := 0
+	var dialdir int8
+
+	// stop sends value to the mapping of the control, if it is configured. A pipeline only has the mappings of its
+	// controls, so the wheel or the dial may have none
+	stop := func(control string, value uint8) {
+		if m, ok := mappings[control]; ok {
+			send(m, value, false)
+		}
+	}
+
+	// tune sends the value of the wheel position through the mapping of the control, if it is configured
+	tune := func(control string, position int8) {
+		if m, ok := mappings[control]; ok {
+			send(m, m.wheelValue(position), true)
+		}
+	}
+
+	// sendOptional sends the command of an optional action, if a mapping is configured for it
+	sendOptional := func(control string) {
+		if m, ok := mappings[control]; ok {
+			send(m, m.Value, false)
+		}
+	}
+
+	stopvalue := devices.StopValue
+	if mp.WheelStopValue >= 0 {
+		stopvalue = uint8(mp.WheelStopValue)
+	}
+
+	// extreme contains the optional action of the wheel at full deflection, which is currently active
+	extreme := ""
+	stopExtreme := func() {
+		if extreme != "" {
+			stop(extreme, devices.StopValue)
+			extreme = ""
+		}
+	}
+
+	// steps is the timer sending the steps accumulated with WheelStepRate. stepped contains the steps not sent yet,
+	// steppos the wheel position and steptime the time the steps were accumulated last
+	steps := time.NewTimer(time.Hour)
+	defer steps.Stop()
+	stopTimer(steps)
+	var stepped float64
+	var steppos int8
+	var steptime time.Time
+	// accumulate starts or continues accumulating steps at the wheel position, 0 stops it
+	accumulate := func(wp int8) {
+		switch {
+		case wp == 0:
+			stopTimer(steps)
+			stepped, steppos = 0, 0
+			return
+		case steppos == 0:
+			steptime = time.Now()
+			steps.Reset(wheelStepInterval)
+		case (wp > 0) != (steppos > 0):
+			stepped = 0
+		}
+		steppos = wp
+	}
+
+	// stopTune sends value to all controllers tuning with the wheel
+	stopTune := func(value uint8) {
+		accumulate(0)
+		for _, c := range []string{ControlWheelUp, ControlWheelDown, ControlWheel, ControlWheelUpFine, ControlWheelDownFine} {
+			stop(c, value)
+		}
+		for i := range mp.WheelBands {
+			stop(bandControl(i, 1), value)
+			stop(bandControl(i, -1), value)
+		}
+	}
+
+	// wheelBand returns the index of the WheelBand containing the wheel position, -1 if there is none
+	wheelBand := func(wp int8) int {
+		for i, b := range mp.WheelBands {
+			if wp != 0 && abs(wp) <= b.Max {
+				return i
+			}
+		}
+		return -1
+	}
+	// band is the index of the WheelBand the wheel tunes with, -1 if none
+	band := -1
+
+	// fineMapping returns the WheelUpFine or WheelDownFine mapping, if the wheel position is within WheelFineThreshold
+	fineMapping := func(wp int8) (Mapping, bool) {
+		if wp == 0 || abs(wp) > mp.WheelFineThreshold {
+			return Mapping{}, false
+		}
+		control := ControlWheelUpFine
+		if wp < 0 {
+			control = ControlWheelDownFine
+		}
+		m, ok := mappings[control]
+		return m, ok
+	}
+	// fine is set while the wheel tunes with a fine mapping
+	fine := false
+
+	// active is the tune mapping which received the last wheel command, direction the sign of the last wheel position
+	active := ""
+	var direction int8
+
+	centered := true
+	stopWheel := func() {
+		stopExtreme()
+		if mp.WheelStopActive {
+			// only the controller which was tuning receives the stop value, the others only stop repeating
+			stopTune(devices.StopValue)
+			if active != "" {
+				stop(active, stopvalue)
+			}
+		} else {
+			stopTune(stopvalue)
+		}
+		active = ""
+		if !centered {
+			centered = true
+			sendOptional(ControlWheelExit)
+			if direction > 0 {
+				sendOptional(ControlWheelExitUp)
+			} else if direction < 0 {
+				sendOptional(ControlWheelExitDown)
+			}
+		}
+	}
+
+	channel := mp.Channel
+	if c := mp.State.Channel; mp.ChannelToggleButton != "" && c != channel &&
+		(c == mp.ChannelToggleChannels[0] || c == mp.ChannelToggleChannels[1]) {
+		channel = c
+		mc.SetChannel(channel - 1)
+	}
+	mp.setChannel(channel)
+
+	// held contains the buttons currently pressed, used to select the DialButton mappings
+	held := make(map[string]bool)
+
+	// dialControl returns the control of the dial mapping, replaced by the DialButton mapping of a held button if configured
+	dialControl := func() string {
+		for i, b := range ButtonControls {
+			if _, ok := mappings[DialButtonControls[i]]; ok && held[b] {
+				return DialButtonControls[i]
+			}
+		}
+		return ControlDial
+	}
+	// extremeButton returns true if a button is held with a mapping for the wheel at full deflection in the direction of
+	// control, which replaces the tune commands
+	extremeButton := func(control string) bool {
+		if control == "" {
+			return false
+		}
+		for _, b := range ButtonControls {
+			if _, ok := mappings[b+control]; ok && held[b] {
+				return true
+			}
+		}
+		return false
+	}
+	// wheelmax is WheelUpMax or WheelDownMax while the wheel is at full deflection
+	wheelmax := ""
+
+	// dial is the mapping used for the last dial command
+	dial, dialcontrol := mappings[ControlDial], ControlDial
+
+	// pressedAt contains the time each button was pressed last, releases the timers of the delayed releases by button
+	pressedAt := make(map[string]time.Time)
+	releases := make(map[string]*time.Timer)
+	releasech := make(chan string)
+	// strikes contains the timers of the notes with VelocityTime, which wait for the release to derive their velocity
+	strikes := make(map[string]*time.Timer)
+	strikech := make(chan string)
+	// strike sends the NoteOn of a pending note with the velocity derived from the time the button was held
+	strike := func(control string) {
+		t, ok := strikes[control]
+		if !ok {
+			return
+		}
+		t.Stop()
+		delete(strikes, control)
+		m := mappings[control]
+		send(m, m.strikeVelocity(time.Since(pressedAt[control])), false)
+	}
+
+	// counters contains the current value of all counter buttons pressed, starting with the restored State
+	counters := make(map[string]uint8, len(mp.State.Counters))
+	for k, v := range mp.State.Counters {
+		counters[k] = v
+	}
+	// stateChanged passes a copy of the runtime state to OnState
+	stateChanged := func() {
+		if mp.OnState == nil {
+			return
+		}
+		state := State{Counters: make(map[string]uint8, len(counters))}
+		if channel != mp.Channel {
+			state.Channel = channel
+		}
+		for k, v := range counters {
+			state.Counters[k] = v
+		}
+		mp.OnState(state)
+	}
+
+	// taps contains the recent presses of the ClockButton, clockpress the time of its last press
+	var taps []time.Time
+	var clockpress time.Time
+	// tapTempo adds a tap of the ClockButton and sets the clock to the average tempo of the recent taps
+	tapTempo := func(t time.Time) {
+		if len(taps) > 0 && t.Sub(taps[len(taps)-1]) > clockTapWindow {
+			taps = taps[:0]
+		}
+		taps = append(taps, t)
+		if len(taps) > clockTaps {
+			taps = taps[1:]
+		}
+		if len(taps) < 2 {
+			return
+		}
+		beat := taps[len(taps)-1].Sub(taps[0]) / time.Duration(len(taps)-1)
+		if err := mc.SetClock(float64(time.Minute) / float64(beat)); err != nil {
+			log.Printf("Setting the clock failed: %v", err)
+		}
+	}
+
+	// actuated contains the time of the last accepted actuation of the controls with a Cooldown. cooling contains the
+	// buttons whose press was ignored, so their release is ignored as well
+	actuated := make(map[string]time.Time)
+	cooling := make(map[string]bool)
+	// coolingDown returns true if the control is actuated within the Cooldown of its mapping, otherwise the actuation
+	// is recorded
+	coolingDown := func(control string) bool {
+		m := mappings[control]
+		if m.Cooldown <= 0 {
+			return false
+		}
+		if t, ok := actuated[control]; ok && time.Since(t) < m.Cooldown {
+			return true
+		}
+		actuated[control] = time.Now()
+		return false
+	}
+
+	sendButton := func(control string, pressed bool) {
+		held[control] = pressed
+		if pressed && extremeButton(wheelmax) {
+			// the button held at full deflection sends its gesture instead of tuning
+			stopExtreme()
+			stopTune(devices.StopValue)
+		}
+		if control == mp.PanicButton {
+			if pressed {
+				stopIdle()
+				stopTimer(dialtimer)
+				stopWheel()
+				stop(dialcontrol, devices.StopValue)
+				for name, out := range outputs {
+					if err := out.Panic(); err != nil {
+						log.Printf("Panic of output %q failed: %v", name, err)
+					}
+				}
+			}
+			return
+		}
+		if control == mp.ClockButton {
+			if pressed {
+				clockpress = time.Now()
+			} else if time.Since(clockpress) >= mp.GestureHoldTime {
+				taps = taps[:0]
+				if err := mc.SetClock(0); err != nil {
+					log.Printf("Stopping the clock failed: %v", err)
+				}
+			} else {
+				tapTempo(clockpress)
+			}
+			return
+		}
+		if control == mp.DeviceCycleButton {
+			if pressed && mp.OnDeviceCycle != nil {
+				go mp.OnDeviceCycle()
+			}
+			return
+		}
+		if control == mp.ChannelToggleButton {
+			if pressed {
+				if channel == mp.ChannelToggleChannels[0] {
+					channel = mp.ChannelToggleChannels[1]
+				} else {
+					channel = mp.ChannelToggleChannels[0]
+				}
+				mc.SetChannel(channel - 1)
+				mp.setChannel(channel)
+				stateChanged()
+			}
+			return
+		}
+		m, ok := mappings[control]
+		if !ok {
+			return
+		}
+		if strings.EqualFold(m.Type, TypeCounter) {
+			if !pressed {
+				return
+			}
+			// the first press and a press while another button is held send the start value
+			value, ok := counters[control]
+			modifier := false
+			for b, h := range held {
+				modifier = modifier || (h && b != control)
+			}
+			if ok && !modifier {
+				value = m.nextCount(value)
+			} else {
+				value = m.Start
+			}
+			counters[control] = value
+			send(m, value, false)
+			stateChanged()
+			return
+		}
+		if m.Edge {
+			// the same command for press and release, for hosts toggling on any message
+			value := m.Value
+			if value == 0 {
+				value = 127
+			}
+			send(m, value, false)
+			return
+		}
+		if t, ok := releases[control]; ok && pressed {
+			// the delayed release of the previous press is sent before the new press
+			t.Stop()
+			delete(releases, control)
+			send(m, 0, false)
+		}
+		if pressed && strings.EqualFold(m.Type, TypeNote) && m.VelocityTime > 0 {
+			// the NoteOn is delayed until the release or VelocityTime, a faster release strikes harder
+			pressedAt[control] = time.Now()
+			strikes[control] = time.AfterFunc(m.VelocityTime, func() {
+				select {
+				case strikech <- control:
+				case <-quitch:
+				}
+			})
+			return
+		}
+		if !pressed {
+			strike(control)
+		}
+		if pressed {
+			pressedAt[control] = time.Now()
+			send(m, 127, m.Repeat)
+		} else if wait := m.MinHold - time.Since(pressedAt[control]); wait > 0 {
+			// hosts debouncing aggressively miss a too short press, so the release is delayed until MinHold elapsed
+			releases[control] = time.AfterFunc(wait, func() {
+				select {
+				case releasech <- control:
+				case <-quitch:
+				}
+			})
+		} else {
+			send(m, 0, false)
+		}
+	}
+
+	dialHandler := func(d dispatch) {
+		dd := int8(1)
+		if d.Event == DialCounterclockwise {
+			dd = -1
+		}
+		if c := dialControl(); c != dialcontrol {
+			// a modifier button was pressed or released, stop the command of the previous mapping
+			stopTimer(dialtimer)
+			stop(dialcontrol, devices.StopValue)
+			dial, dialcontrol = mappings[c], c
+			dialcount, lastdir = 0, 0
+		}
+		if _, ok := mappings[dialcontrol]; !ok {
+			return
+		}
+
+		if coolingDown(dialcontrol) {
+			return
+		}
+
+		// only every Divider-th detent in the same direction sends a command
+		if dd != dialdir {
+			dialdir, dialcount = dd, 0
+		}
+		dialcount++
+		if dialcount < int(dial.Divider) {
+			return
+		}
+		dialcount = 0
+
+		// repeat the command while the dial keeps moving in the same direction within DialRepeatWindow
+		stopTimer(dialtimer)
+		interval := time.Since(lastdial)
+		if dd != lastdir {
+			// a reversal starts slowly
+			interval = dial.SpeedTime
+		}
+		sustained := mp.DialRepeatWindow > 0 && dd == lastdir && interval <= mp.DialRepeatWindow
+		lastdial, lastdir = time.Now(), dd
+		value := dial.dialSpeedValue(dd, interval)
+		// a Burst sends the command several times per detent, only the last one is repeated
+		for i := 1; i < int(dial.Burst); i++ {
+			send(dial, value, false)
+		}
+		send(dial, value, sustained)
+		if sustained {
+			dialtimer.Reset(mp.DialRepeatWindow)
+		}
+	}
+	// handlers is the dispatch table containing the handler of each event, which sends the commands of the mappings
+	handlers := map[Event]handler{
+		WheelMoved: func(d dispatch) {
+			wp := d.Value
+			stopIdle()
+			stopTimer(returning)
+			if mp.WheelReverse {
+				wp = -wp
+			}
+			if returned != 0 && wp != 0 && (wp > 0) == (returned > 0) && abs(wp) <= abs(returned) {
+				// the wheel is still on its way back to center after WheelReturnTimeout stopped it
+				returned = wp
+				return
+			}
+			returned, wheelpos = 0, wp
+			if abs(wp) <= mp.WheelCenterWindow {
+				// positions within the center window are handled like the center position
+				wp = 0
+			}
+			if wp != 0 && centered {
+				centered = false
+				sendOptional(ControlWheelEnter)
+			}
+			if wp > 0 {
+				direction = 1
+			} else if wp < 0 {
+				direction = -1
+			}
+			control := ""
+			if wp >= mp.WheelMax {
+				control = ControlWheelUpMax
+			} else if wp <= -mp.WheelMax {
+				control = ControlWheelDownMax
+			}
+			if wheelmax != "" && control == "" && wp != 0 && mp.WheelReturnTimeout > 0 {
+				// the wheel left full deflection towards center, it is stopped unless it keeps moving
+				returning.Reset(mp.WheelReturnTimeout)
+			}
+			wheelmax = control
+			if extremeButton(control) {
+				// the button held at full deflection sends its gesture instead of tuning
+				stopExtreme()
+				stopTune(devices.StopValue)
+			} else if m, ok := mappings[control]; ok {
+				// the configured action at full deflection replaces the repeated tune commands
+				stopTune(devices.StopValue)
+				if extreme != control {
+					extreme = control
+					send(m, m.Value, m.Repeat)
+				}
+			} else {
+				stopExtreme()
+				finemapping, isfine := fineMapping(wp)
+				b := wheelBand(wp)
+				if isfine != fine || b != band {
+					// switching between fine and coarse tuning or between bands, stop the repeated command of the
+					// previous mapping
+					stopTune(devices.StopValue)
+					fine, band = isfine, b
+				}
+				if mp.WheelStepRate > 0 && wp != 0 && abs(wp) <= mp.WheelMax {
+					active = ControlWheelUp
+					if wp < 0 {
+						active = ControlWheelDown
+					}
+					accumulate(wp)
+				} else if b >= 0 {
+					active = bandControl(b, wp)
+					tune(active, abs(wp))
+				} else if isfine {
+					active = ControlWheelUpFine
+					if wp < 0 {
+						active = ControlWheelDownFine
+					}
+					send(finemapping, finemapping.wheelValue(abs(wp)), true)
+				} else if m, ok := mappings[ControlWheel]; ok && wp != 0 && abs(wp) <= mp.WheelMax {
+					// a single controller for both directions relative to its center value
+					active = ControlWheel
+					send(m, m.centerValue(wp), true)
+				} else if wp > 0 && wp <= mp.WheelMax && mp.WheelPositiveInvert {
+					// Invert positive wheel positions to work around bug in SDR Console with Tune Up
+					active = ControlWheelUp
+					tune(active, mp.WheelMax+1-wp)
+				} else if wp > 0 && wp <= mp.WheelMax {
+					active = ControlWheelUp
+					tune(active, wp)
+				} else if wp >= -mp.WheelMax && wp < 0 && mp.WheelNegativeInvert {
+					active = ControlWheelDown
+					tune(active, mp.WheelMax+1+wp)
+				} else if wp >= -mp.WheelMax && wp < 0 {
+					active = ControlWheelDown
+					tune(active, -wp)
+				} else {
+					stopWheel()
+					return
+				}
+			}
+			if mp.WheelIdleTimeout > 0 {
+				idle.Reset(mp.WheelIdleTimeout)
+			}
+		},
+		WheelIdle: func(d dispatch) {
+			log.Println("Wheel idle timeout reached, stopping wheel")
+			stopWheel()
+		},
+		WheelStepDue: func(d dispatch) {
+			if steppos == 0 {
+				return
+			}
+			m, ok := mappings[active]
+			if !ok {
+				return
+			}
+			now := time.Now()
+			stepped += float64(abs(steppos)) * mp.WheelStepRate * now.Sub(steptime).Seconds()
+			steptime = now
+			value := m.Value
+			if value == 0 {
+				value = 127
+			}
+			for ; stepped >= 1; stepped-- {
+				send(m, value, false)
+			}
+			steps.Reset(wheelStepInterval)
+		},
+		WheelReturnDue: func(d dispatch) {
+			log.Printf("Wheel returning from %v, stopping wheel", wheelpos)
+			returned = wheelpos
+			stopWheel()
+		},
+		DialClockwise:        dialHandler,
+		DialCounterclockwise: dialHandler,
+		DialIdle: func(d dispatch) {
+			stop(dialcontrol, devices.StopValue)
+		},
+		ButtonPressed: func(d dispatch) {
+			if coolingDown(d.Control) {
+				cooling[d.Control] = true
+				return
+			}
+			sendButton(d.Control, true)
+		},
+		ButtonReleased: func(d dispatch) {
+			if cooling[d.Control] {
+				delete(cooling, d.Control)
+				return
+			}
+			sendButton(d.Control, false)
+		},
+		NoteStrikeDue: func(d dispatch) {
+			strike(d.Control)
+		},
+		ButtonReleaseDue: func(d dispatch) {
+			if _, ok := releases[d.Control]; ok {
+				delete(releases, d.Control)
+				send(mappings[d.Control], 0, false)
+			}
+		},
+		GestureDetected: func(d dispatch) {
+			g := d.Gesture
+			if g.Type == devices.WheelExtreme && mp.WheelReverse {
+				g.Value = -g.Value
+			}
+			if bank, ok := mappings[ControlBank]; ok && (g.Type == devices.Tap || g.Type == devices.Chord) {
+				// the buttons select a numbered bank, e.g. a memory channel of the host
+				number := int(bank.Start) + int(bankNumber(g))
+				if number > 127 {
+					number = 127
+				}
+				send(bank, uint8(number), false)
+			}
+			m, ok := mappings[gestureControl(g)]
+			if !ok {
+				return
+			}
+			if g.Type == devices.WheelVelocity {
+				step := int(m.Step)
+				if step == 0 {
+					step = 1
+				}
+				value := g.Value * step
+				if value > 127 {
+					value = 127
+				}
+				send(m, uint8(value), false)
+				return
+			}
+			value := m.Value
+			if value == 0 {
+				value = 127
+			}
+			send(m, value, false)
+		},
+		DeviceError: func(d dispatch) {
+			// the device is reopened by the ShuttlExpress driver, stop all commands of the lost wheel position
+			log.Printf("ShuttlExpress disconnected: %v", d.Err)
+			stopIdle()
+			stopTimer(dialtimer)
+			stopWheel()
+			stop(dialcontrol, devices.StopValue)
+			// the dial restarts counting after the reconnect, detents before the loss don't count towards the next command
+			dialcount, dialdir, lastdir, lastdial = 0, 0, 0, time.Time{}
+		},
+	}
+
+	dispatchEvent := func(d dispatch) {
+		handlers[d.Event](d)
+	}
+
+	// forward passes an event to the gesture detector. Gestures detected meanwhile are dispatched, as the detector
+	// doesn't receive further events until its gestures are received
+	forward := func(e devices.Event) {
+		for {
+			select {
+			case gestureEvents <- e:
+				return
+			case g := <-gestures:
+				dispatchEvent(dispatch{Event: GestureDetected, Gesture: g})
+			case <-quitch:
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-quitch:
+			return
+		case e := <-events:
+			if mp.OnEvent != nil {
+				mp.OnEvent(e)
+			}
+			if ch, ok := routes[e.Control]; ok {
+				// the control is handled by a pipeline, which must not block the others
+				select {
+				case ch <- e:
+				default:
+					log.Printf("Pipeline of %v busy, dropping event %v", e.Control, e)
+				}
+				continue
+			}
+			d := deviceDispatch(e)
+			dispatchEvent(d)
+			if c := d.control(mp.WheelReverse); c != "" && mp.OnControl != nil {
+				mp.OnControl(c)
+			}
+			if gestureEvents != nil {
+				forward(e)
+			}
+		case <-idle.C:
+			dispatchEvent(dispatch{Event: WheelIdle})
+		case <-returning.C:
+			dispatchEvent(dispatch{Event: WheelReturnDue})
+		case <-steps.C:
+			dispatchEvent(dispatch{Event: WheelStepDue})
+		case <-dialtimer.C:
+			dispatchEvent(dispatch{Event: DialIdle})
+		case c := <-releasech:
+			dispatchEvent(dispatch{Event: ButtonReleaseDue, Control: c})
+		case c := <-strikech:
+			dispatchEvent(dispatch{Event: NoteStrikeDue, Control: c})
+		case g := <-gestures:
+			dispatchEvent(dispatch{Event: GestureDetected, Gesture: g})
+		case err := <-errors:
+			for _, ch := range errs {
+				select {
+				case ch <- err:
+				default:
+				}
+			}
+			dispatchEvent(dispatch{Event: DeviceError, Err: err})
+		}
+	}
+}
+
+// stopTimer stops the timer and drains its channel, so it can be reset safely
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
+
+// abs returns the absolute value of v
+func abs(v int8) int8 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,152 @@
+package mapping_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dg1psi/shuttlemidi/devices"
+	"github.com/dg1psi/shuttlemidi/mapping"
+	"gitlab.com/gomidi/midi/testdrv"
+)
+
+func TestBankSelection(t *testing.T) {
+	tests := []struct {
+		name     string
+		buttons  []devices.Control
+		expected uint8
+	}{
+		{"tap", []devices.Control{devices.Button3}, 4},
+		{"chord of two buttons", []devices.Control{devices.Button1, devices.Button2}, 3},
+		{"chord of three buttons", []devices.Control{devices.Button1, devices.Button3, devices.Button5}, 21},
+		{"chord of three other buttons", []devices.Control{devices.Button2, devices.Button4, devices.Button5}, 26},
+		{"chord of all buttons", []devices.Control{devices.Button1, devices.Button2, devices.Button3, devices.Button4, devices.Button5}, 31},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := devices.NewMIDIController(testdrv.New("bank"), "bank", 100*time.Millisecond, 0, devices.MidiOptions{})
+			if err := out.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer out.Close()
+
+			mappings := map[string]mapping.Mapping{mapping.ControlBank: {Name: "Memory", Type: mapping.TypeProgram}}
+			for i, c := range mapping.Controls {
+				mappings[c] = mapping.Mapping{Controller: uint8(i)}
+			}
+			ready := make(chan struct{}, 1)
+			programs := make(chan uint8, 8)
+			mapper, err := mapping.NewMapper(mappings, mapping.Options{
+				Channel:              1,
+				WheelMax:             7,
+				GestureHoldTime:      500 * time.Millisecond,
+				GestureDoubleTapTime: 50 * time.Millisecond,
+				GestureChordWindow:   30 * time.Millisecond,
+				OnChannel:            func(uint8) { ready <- struct{}{} },
+				OnSend: func(_ string, cmd devices.Command) {
+					if cmd.Type == devices.ProgramChange {
+						programs <- cmd.Data1
+					}
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			se := devices.NewVirtualShuttlExpress()
+			quitch := make(chan struct{})
+			defer close(quitch)
+			go mapper.Run(quitch, se, map[string]devices.MidiController{"": out})
+			<-ready
+
+			for _, b := range tt.buttons {
+				se.Simulate(b, 1)
+			}
+			time.Sleep(50 * time.Millisecond)
+			for _, b := range tt.buttons {
+				se.Simulate(b, 0)
+			}
+
+			select {
+			case p := <-programs:
+				if p != tt.expected {
+					t.Errorf("bank %v selected, expected %v", p, tt.expected)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("no bank selected, expected %v", tt.expected)
+			}
+			select {
+			case p := <-programs:
+				t.Errorf("second bank %v selected", p)
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestNewMapper(t *testing.T) {
+	mapper, err := mapping.NewMapper(nil, mapping.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapper.Channel != 1 || mapper.WheelMax != 7 || mapper.GestureHoldTime != 500*time.Millisecond ||
+		mapper.GestureDoubleTapTime != 300*time.Millisecond || mapper.GestureChordWindow != 100*time.Millisecond {
+		t.Errorf("defaults not applied: %+v", mapper.Options)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		mappings map[string]mapping.Mapping
+		options  mapping.Options
+	}{
+		{"channel toggle with one channel", nil, mapping.Options{ChannelToggleButton: mapping.ControlButton1, ChannelToggleChannels: []uint8{2}}},
+		{"channel toggle without channels", nil, mapping.Options{ChannelToggleButton: mapping.ControlButton1}},
+		{"unknown panic button", nil, mapping.Options{PanicButton: "Button6"}},
+		{"wheel max out of range", nil, mapping.Options{WheelMax: 8}},
+		{"center window beyond wheel max", nil, mapping.Options{WheelMax: 5, WheelCenterWindow: 5}},
+		{"negative hold time", nil, mapping.Options{GestureHoldTime: -time.Second}},
+		{"invalid mapping", map[string]mapping.Mapping{mapping.ControlDialButton1: {SpeedTime: time.Second}}, mapping.Options{}},
+	} {
+		if _, err := mapping.NewMapper(tt.mappings, tt.options); err == nil {
+			t.Errorf("%v: no error returned", tt.name)
+		}
+	}
+}
+
+func TestMissingMapping(t *testing.T) {
+	out := devices.NewMIDIController(testdrv.New("missing"), "missing", 100*time.Millisecond, 0, devices.MidiOptions{})
+	if err := out.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	ready := make(chan struct{}, 1)
+	sent := make(chan devices.Command, 8)
+	mapper, err := mapping.NewMapper(map[string]mapping.Mapping{mapping.ControlButton1: {Controller: 20}}, mapping.Options{
+		OnChannel: func(uint8) { ready <- struct{}{} },
+		OnSend:    func(_ string, cmd devices.Command) { sent <- cmd },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	se := devices.NewVirtualShuttlExpress()
+	quitch := make(chan struct{})
+	defer close(quitch)
+	go mapper.Run(quitch, se, map[string]devices.MidiController{"": out})
+	<-ready
+
+	// the controls without a mapping don't send anything, the button with a mapping still does
+	se.Simulate(devices.Button2, 1)
+	se.Simulate(devices.Button2, 0)
+	se.Simulate(devices.Wheel, 3)
+	se.Simulate(devices.Wheel, 0)
+	se.Simulate(devices.Dial, 1)
+	se.Simulate(devices.Button1, 1)
+	select {
+	case cmd := <-sent:
+		if cmd.Data1 != 20 {
+			t.Errorf("command %v sent, expected the press of Button1", cmd)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("press of Button1 not sent")
+	}
+}
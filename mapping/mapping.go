@@ -0,0 +1,536 @@
+// Package mapping maps the events of a ShuttlExpress to MIDI commands. It contains the Mapping of each control and the
+// Mapper sending the commands, which can be used without the ShuttleMidi application
+package mapping
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dg1psi/shuttlemidi/devices"
+)
+
+// Identifiers of the ShuttlExpress controls used as keys of the Mappings configuration
+const (
+	ControlWheelUp   = "WheelUp"
+	ControlWheelDown = "WheelDown"
+	ControlDial      = "Dial"
+	ControlButton1   = "Button1"
+	ControlButton2   = "Button2"
+	ControlButton3   = "Button3"
+	ControlButton4   = "Button4"
+	ControlButton5   = "Button5"
+
+	ControlWheel         = "Wheel"
+	ControlWheelUpFine   = "WheelUpFine"
+	ControlWheelDownFine = "WheelDownFine"
+	ControlWheelEnter    = "WheelEnter"
+	ControlWheelExit     = "WheelExit"
+	ControlWheelExitUp   = "WheelExitUp"
+	ControlWheelExitDown = "WheelExitDown"
+	ControlWheelUpMax    = "WheelUpMax"
+	ControlWheelDownMax  = "WheelDownMax"
+
+	ControlDialButton1 = "DialButton1"
+	ControlDialButton2 = "DialButton2"
+	ControlDialButton3 = "DialButton3"
+	ControlDialButton4 = "DialButton4"
+	ControlDialButton5 = "DialButton5"
+
+	ControlWheelVelocity = "WheelVelocity"
+
+	ControlBank = "Bank"
+)
+
+// Controls contains the identifiers of all ShuttlExpress controls
+var Controls = []string{ControlWheelUp, ControlWheelDown, ControlDial, ControlButton1, ControlButton2, ControlButton3, ControlButton4, ControlButton5}
+
+// OptionalControls contains the identifiers of actions which are only sent if a mapping is configured for them.
+// WheelEnter is sent when the wheel leaves the center position, WheelExit when it returns to it, followed by
+// WheelExitUp or WheelExitDown depending on the direction the wheel returned from.
+// WheelUpMax and WheelDownMax replace the tune commands while the wheel is at full deflection (±7).
+// Wheel replaces WheelUp and WheelDown by a single controller relative to its center value (see centerValue).
+// WheelUpFine and WheelDownFine replace the tune commands while the wheel position is within WheelFineThreshold.
+// DialButton1 to DialButton5 replace the Dial mapping while the button is held.
+// Bank is sent for each tap or chord of the buttons with the bank number of the buttons (see bankNumber).
+// The gesture actions are described at GestureControls
+var OptionalControls = append(append([]string{ControlWheel, ControlWheelUpFine, ControlWheelDownFine, ControlWheelEnter, ControlWheelExit, ControlWheelExitUp, ControlWheelExitDown, ControlWheelUpMax, ControlWheelDownMax, ControlBank}, DialButtonControls...), GestureControls()...)
+
+// DialButtonControls contains the identifiers of the dial mappings used while a button is held, in button order
+var DialButtonControls = []string{ControlDialButton1, ControlDialButton2, ControlDialButton3, ControlDialButton4, ControlDialButton5}
+
+// ButtonControls contains the identifiers of the buttons in button order
+var ButtonControls = []string{ControlButton1, ControlButton2, ControlButton3, ControlButton4, ControlButton5}
+
+// GestureControls returns the identifiers of the gesture actions. Button1Tap to Button5Tap are sent for a short press
+// without a second one, Button1DoubleTap to Button5DoubleTap for two short presses and Button1Hold to Button5Hold once
+// the button is held for GestureHoldTime. Chord followed by the button numbers, like Chord12 or Chord135, is sent when
+// the buttons are pressed together. WheelVelocity is sent with the wheel positions changed per second.
+// Button1WheelUpMax to Button5WheelDownMax are sent once when the wheel is at full deflection while the button is held
+func GestureControls() []string {
+	var gc []string
+	for _, b := range ButtonControls {
+		gc = append(gc, b+devices.Tap.String(), b+devices.DoubleTap.String(), b+devices.Hold.String(), b+ControlWheelUpMax, b+ControlWheelDownMax)
+	}
+	for bs := devices.ButtonState(1); bs < 1<<len(ButtonControls); bs++ {
+		if bs&(bs-1) != 0 {
+			gc = append(gc, chordControl(bs))
+		}
+	}
+	return append(gc, ControlWheelVelocity)
+}
+
+// chordControl returns the identifier of the chord of the buttons
+func chordControl(bs devices.ButtonState) string {
+	c := devices.Chord.String()
+	for i := range ButtonControls {
+		if bs&(1<<i) != 0 {
+			c += fmt.Sprint(i + 1)
+		}
+	}
+	return c
+}
+
+// bankNumber returns the number selected by a Tap or Chord gesture for the Bank mapping. Each button adds its value
+// to the number: Button1 1, Button2 2, Button3 4, Button4 8 and Button5 16, so the combinations select 1 to 31
+func bankNumber(g devices.Gesture) uint8 {
+	if g.Type == devices.Chord {
+		return uint8(g.Buttons)
+	}
+	return 1 << (g.Control - devices.Button1)
+}
+
+// gestureControl returns the identifier of the action of the gesture
+func gestureControl(g devices.Gesture) string {
+	switch g.Type {
+	case devices.Chord:
+		return chordControl(g.Buttons)
+	case devices.WheelVelocity:
+		return ControlWheelVelocity
+	case devices.WheelExtreme:
+		if g.Value < 0 {
+			return g.Control.String() + ControlWheelDownMax
+		}
+		return g.Control.String() + ControlWheelUpMax
+	}
+	return g.Control.String() + g.Type.String()
+}
+
+// Mapping contains the MIDI message a ShuttlExpress control or action is mapped to
+type Mapping struct {
+	// Name is the friendly name of the mapping used for logging
+	Name string
+	// Controller is the number of the controller sent by ControlChange messages
+	Controller uint8
+	// Value is sent by actions which don't derive the value from the control, like WheelEnter, WheelExit and the gesture
+	// actions other than WheelVelocity (default 127)
+	Value uint8
+	// Repeat repeats the command of a pressed button until the button is released
+	Repeat bool
+	// RepeatDelay is the delay between two repeated messages, e.g. separate tuning speeds for WheelUp and WheelDown. 0
+	// uses the default delay
+	RepeatDelay time.Duration
+	// Backend names the output backend the command is sent to. An empty name uses the MIDI device selected in the tray
+	Backend string
+	// Also lists further backends receiving the same command, e.g. to fan out a control to two hosts
+	Also []string
+	// Step scales the value derived from the control: the value per wheel position (default 18), per dial detent
+	// (default 1) or per wheel position changed per second of WheelVelocity (default 1). Counters count by Step
+	Step uint8
+	// Encoding selects the relative encoding of the dial, see dialValue
+	Encoding string
+	// Center is the value of the Wheel mapping at the center position (default 64)
+	Center uint8
+	// Type selects the message sent by a button: a ControlChange (empty or "cc"), a NoteOn when pressed and a NoteOff
+	// when released ("note") or a ControlChange counting from Start to Max ("counter", see nextCount). The Bank mapping
+	// sends a ProgramChange instead ("program")
+	Type string
+	// Note and Velocity (default 127) are sent by note mappings
+	Note     uint8
+	Velocity uint8
+	// Channel overrides the MIDI channel (1-16) of the mapping, 0 uses the channel of the MIDI device
+	Channel uint8
+	// Divider coarsens the dial by only sending a command for every Divider-th detent in the same direction
+	Divider uint8
+	// Burst refines the dial by sending the command of a detent Burst times, e.g. several tuning steps per detent
+	Burst uint8
+	// Curve shapes the value derived from the wheel position, see shape. Table contains the values of the "table" curve
+	Curve string
+	Table []uint8
+	// SendMode overrides when the command is sent: only once per change ("onchange") or every SendInterval until the
+	// value changes ("periodic"). An empty SendMode keeps the default behavior of the control
+	SendMode     string
+	SendInterval time.Duration
+	// Start is the first value of a counter
+	Start uint8
+	// Max above 0 is the ceiling of all controller values. The values of WheelUp, WheelDown and the fine mappings are
+	// scaled to the range up to Max, all other values are clamped to it. Counters count up to Max (default 127)
+	Max uint8
+	// Edge sends the same command with Value when a button is pressed and released
+	Edge bool
+	// TickStep changes the controller value by the given amount on each repetition, e.g. for accelerating controls
+	TickStep int8
+	// Invert sends the controller values reversed, 127 - value or Max - value if Max is set
+	Invert bool
+	// MinHold delays the release of a button until it was held for the given duration, for hosts missing short presses
+	MinHold time.Duration
+	// Cooldown ignores further presses of a button or detents of the dial for the given duration after an accepted one
+	Cooldown time.Duration
+	// VelocityTime derives the velocity of a note from how quickly the button is released, see strikeVelocity
+	VelocityTime time.Duration
+	// SpeedTime encodes the speed of the dial in the step of its relative value, see dialSpeedValue
+	SpeedTime time.Duration
+}
+
+// Send modes of a mapping
+const (
+	SendDefault  = ""
+	SendOnChange = "onchange"
+	SendPeriodic = "periodic"
+)
+
+// ValidSendMode returns true if the send mode of the mapping is supported
+func (m Mapping) ValidSendMode() bool {
+	return m.SendMode == SendDefault || strings.EqualFold(m.SendMode, SendOnChange) || strings.EqualFold(m.SendMode, SendPeriodic)
+}
+
+// Value curves of a mapping
+const (
+	CurveLinear      = ""
+	CurveLogarithmic = "log"
+	CurveExponential = "exp"
+	CurveTable       = "table"
+)
+
+// curves contains all supported value curves
+var curves = []string{CurveLinear, "linear", CurveLogarithmic, CurveExponential, CurveTable}
+
+// ValidCurve returns true if the value curve of the mapping is supported and a table curve contains valid values
+func (m Mapping) ValidCurve() bool {
+	if strings.EqualFold(m.Curve, CurveTable) {
+		if len(m.Table) < 2 {
+			return false
+		}
+		for _, v := range m.Table {
+			if v > 127 {
+				return false
+			}
+		}
+		return true
+	}
+	for _, c := range curves {
+		if strings.EqualFold(m.Curve, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// shape applies the value curve to the linear value v in the range 0 to max. "log" rises fast for small values, "exp"
+// slowly. "table" spreads the values of Table equally over the range and returns the nearest one
+func (m Mapping) shape(v int, max int) int {
+	if max <= 0 {
+		return v
+	}
+	x := float64(v) / float64(max)
+	switch strings.ToLower(m.Curve) {
+	case CurveLogarithmic:
+		return int(math.Round(float64(max) * math.Log10(1+9*x)))
+	case CurveExponential:
+		return int(math.Round(float64(max) * (math.Pow(10, x) - 1) / 9))
+	case CurveTable:
+		if len(m.Table) < 2 {
+			return v
+		}
+		return int(m.Table[int(math.Round(x*float64(len(m.Table)-1)))])
+	}
+	return v
+}
+
+// Message types of a mapping
+const (
+	TypeControlChange = "cc"
+	TypeNote          = "note"
+	TypeCounter       = "counter"
+	TypeProgram       = "program"
+)
+
+// ValidType returns true if the message type of the mapping is supported
+func (m Mapping) ValidType() bool {
+	return m.Type == "" || strings.EqualFold(m.Type, TypeControlChange) || strings.EqualFold(m.Type, TypeNote) ||
+		strings.EqualFold(m.Type, TypeCounter) || strings.EqualFold(m.Type, TypeProgram)
+}
+
+// nextCount returns the value of a counter mapping following value. After Max the counter wraps around to Start
+func (m Mapping) nextCount(value uint8) uint8 {
+	step, max := int(m.Step), int(m.Max)
+	if step == 0 {
+		step = 1
+	}
+	if max == 0 {
+		max = 127
+	}
+	if v := int(value) + step; v <= max {
+		return uint8(v)
+	}
+	return m.Start
+}
+
+// Relative encodings of the dial
+const (
+	EncodingDefault        = ""               // 2 clockwise, 1 counterclockwise
+	EncodingBinaryOffset   = "binaryoffset"   // 64 + step clockwise, 64 - step counterclockwise
+	EncodingTwosComplement = "twoscomplement" // step clockwise, 128 - step counterclockwise
+	EncodingSignedBit      = "signedbit"      // step clockwise, 64 + step counterclockwise
+)
+
+// encodings contains all supported relative encodings of the dial
+var encodings = []string{EncodingDefault, EncodingBinaryOffset, EncodingTwosComplement, EncodingSignedBit}
+
+// ValidEncoding returns true if the relative encoding is supported
+func ValidEncoding(encoding string) bool {
+	for _, e := range encodings {
+		if strings.EqualFold(encoding, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the ranges, type, encoding, curve and send mode of the mapping of the control or action with the
+// given identifier and returns the first problem found
+func (m Mapping) Validate(control string) error {
+	if m.Controller > 127 || m.Value > 127 {
+		return fmt.Errorf("controller %v or value %v of mapping %v is outside of the range 0 to 127", m.Controller, m.Value, control)
+	}
+	if m.RepeatDelay < 0 || m.MinHold < 0 || m.Cooldown < 0 || m.VelocityTime < 0 || m.SpeedTime < 0 {
+		return fmt.Errorf("RepeatDelay, MinHold, Cooldown, VelocityTime and SpeedTime of mapping %v must not be negative", control)
+	}
+	if m.SpeedTime > 0 && (!strings.HasPrefix(control, ControlDial) || m.Encoding == EncodingDefault) {
+		return fmt.Errorf("SpeedTime of mapping %v requires a dial mapping with an encoding", control)
+	}
+	if m.VelocityTime > 0 && !strings.EqualFold(m.Type, TypeNote) {
+		return fmt.Errorf("VelocityTime of mapping %v is only supported for notes", control)
+	}
+	if !ValidEncoding(m.Encoding) {
+		return fmt.Errorf("unknown encoding %v of mapping %v", m.Encoding, control)
+	}
+	if !m.ValidType() {
+		return fmt.Errorf("unknown type %v of mapping %v", m.Type, control)
+	}
+	if (strings.EqualFold(m.Type, TypeNote) || strings.EqualFold(m.Type, TypeCounter)) && !strings.HasPrefix(control, "Button") {
+		return fmt.Errorf("type %v of mapping %v is only supported for buttons", m.Type, control)
+	}
+	if strings.EqualFold(m.Type, TypeProgram) && control != ControlBank {
+		return fmt.Errorf("type %v of mapping %v is only supported for %v", m.Type, control, ControlBank)
+	}
+	if m.Start > 127 || m.Max > 127 || (m.Max > 0 && m.Start > m.Max) {
+		return fmt.Errorf("start %v or max %v of mapping %v is invalid", m.Start, m.Max, control)
+	}
+	if m.Center > 127 {
+		return fmt.Errorf("center %v of mapping %v is outside of the range 0 to 127", m.Center, control)
+	}
+	if m.Note > 127 || m.Velocity > 127 {
+		return fmt.Errorf("note %v or velocity %v of mapping %v is outside of the range 0 to 127", m.Note, m.Velocity, control)
+	}
+	if !m.ValidCurve() {
+		return fmt.Errorf("unknown curve %v or invalid table of mapping %v", m.Curve, control)
+	}
+	if !m.ValidSendMode() || m.SendInterval < 0 {
+		return fmt.Errorf("unknown send mode %v or negative send interval of mapping %v", m.SendMode, control)
+	}
+	if m.Channel > 16 {
+		return fmt.Errorf("channel %v of mapping %v is outside of the range 1 to 16", m.Channel, control)
+	}
+	return nil
+}
+
+// wheelValue returns the controller value for the absolute wheel position (1-7) scaled by Step and shaped by Curve.
+// The result is clamped to 127 and scaled to the range up to Max
+func (m Mapping) wheelValue(position int8) uint8 {
+	step := int(m.Step)
+	if step == 0 {
+		step = 18
+	}
+	v := step * int(position)
+	if v > 127 {
+		v = 127
+	}
+	v = m.shape(v, 127)
+	if m.Max > 0 {
+		v = v * int(m.Max) / 127
+	}
+	return uint8(v)
+}
+
+// centerValue returns the controller value for the wheel position (-7 to 7) relative to Center, using a default step of
+// 9 per position. The distance to Center is shaped by Curve and the result is clamped to 0-127
+func (m Mapping) centerValue(position int8) uint8 {
+	center, step := int(m.Center), int(m.Step)
+	if center == 0 {
+		center = 64
+	}
+	if step == 0 {
+		step = 9
+	}
+	if position < 0 {
+		d := step * int(-position)
+		if d > center {
+			d = center
+		}
+		return uint8(center - m.shape(d, center))
+	}
+	d := step * int(position)
+	if d > 127-center {
+		d = 127 - center
+	}
+	return uint8(center + m.shape(d, 127-center))
+}
+
+// dialValue returns the controller value for a dial detent in the given direction using the relative encoding of the
+// mapping
+func (m Mapping) dialValue(direction int8) uint8 {
+	step := m.Step
+	if step == 0 {
+		step = 1
+	}
+	return m.encodeDial(direction, step)
+}
+
+// dialSpeedValue returns the controller value for a dial detent in the given direction turned interval after the
+// previous one. With SpeedTime the step grows from Step (default 1) for detents SpeedTime or more apart up to 63 for
+// detents in quick succession, shaped by Curve. Without SpeedTime it returns dialValue
+func (m Mapping) dialSpeedValue(direction int8, interval time.Duration) uint8 {
+	if m.SpeedTime <= 0 {
+		return m.dialValue(direction)
+	}
+	step := int(m.Step)
+	if step == 0 {
+		step = 1
+	}
+	if step > 63 {
+		step = 63
+	}
+	speed := 0
+	if interval < m.SpeedTime {
+		speed = int(63 * (m.SpeedTime - interval) / m.SpeedTime)
+	}
+	step += m.shape(speed, 63) * (63 - step) / 63
+	if step > 63 {
+		step = 63
+	}
+	return m.encodeDial(direction, uint8(step))
+}
+
+// encodeDial returns the controller value for the step (up to 63) in the given direction using the relative encoding
+// of the mapping. The default encoding ignores the step
+func (m Mapping) encodeDial(direction int8, step uint8) uint8 {
+	if step > 63 {
+		step = 63
+	}
+	switch strings.ToLower(m.Encoding) {
+	case EncodingBinaryOffset:
+		if direction > 0 {
+			return 64 + step
+		}
+		return 64 - step
+	case EncodingTwosComplement:
+		if direction > 0 {
+			return step
+		}
+		return 128 - step
+	case EncodingSignedBit:
+		if direction > 0 {
+			return step
+		}
+		return 64 + step
+	}
+	if direction > 0 {
+		return 2
+	}
+	return 1
+}
+
+// strikeVelocity returns the velocity of a note with VelocityTime for a button held for the given duration. A release
+// right after the press strikes with 127, holding it for VelocityTime or longer with Velocity (default 1). Curve shapes
+// the velocities in between
+func (m Mapping) strikeVelocity(held time.Duration) uint8 {
+	soft := int(m.Velocity)
+	if soft == 0 {
+		soft = 1
+	}
+	speed := 0
+	if held < m.VelocityTime {
+		speed = int(127 * (m.VelocityTime - held) / m.VelocityTime)
+	}
+	return uint8(soft + m.shape(speed, 127)*(127-soft)/127)
+}
+
+// Command creates the command of the mapping for the value. For note mappings a value of 0 creates a NoteOff and any
+// other value a NoteOn, which is never repeated. With VelocityTime the value is the velocity of the NoteOn. Program
+// mappings create a ProgramChange to the value
+func (m Mapping) Command(value uint8, repeat bool) devices.Command {
+	if strings.EqualFold(m.Type, TypeProgram) {
+		return devices.Command{Name: m.Name, Type: devices.ProgramChange, Channel: m.Channel, Data1: value}
+	}
+	if strings.EqualFold(m.Type, TypeNote) {
+		if value == 0 {
+			return devices.Command{Name: m.Name, Type: devices.NoteOff, Channel: m.Channel, Data1: m.Note}
+		}
+		velocity := m.Velocity
+		if m.VelocityTime > 0 {
+			velocity = value
+		} else if velocity == 0 {
+			velocity = 127
+		}
+		return devices.Command{Name: m.Name, Type: devices.NoteOn, Channel: m.Channel, Data1: m.Note, Data2: velocity}
+	}
+	if m.Max > 0 && value > m.Max && value <= 127 {
+		value = m.Max
+	}
+	if m.Invert && value <= 127 {
+		ceiling := uint8(127)
+		if m.Max > 0 {
+			ceiling = m.Max
+		}
+		value = ceiling - value
+	}
+	cmd := devices.Command{Name: m.Name, Type: devices.ControlChange, Channel: m.Channel, Data1: m.Controller, Data2: value, Repeat: repeat, Delay: m.RepeatDelay, TickStep: m.TickStep}
+	switch {
+	case strings.EqualFold(m.SendMode, SendOnChange):
+		cmd.Repeat = false
+	case strings.EqualFold(m.SendMode, SendPeriodic) && value <= 127:
+		cmd.Repeat, cmd.Continuous = true, true
+		if m.SendInterval > 0 {
+			cmd.Delay = m.SendInterval
+		}
+	}
+	return cmd
+}
+
+// ControlID returns the identifier of the control matching name case-insensitively
+func ControlID(name string) (string, bool) {
+	for _, c := range append(Controls, OptionalControls...) {
+		if strings.EqualFold(name, c) {
+			return c, true
+		}
+	}
+	return "", false
+}
+
+// NormalizeMappings restores the control identifiers used by the application as keys, as Viper converts all keys to
+// lower case. The keys not matching any control are returned as unknown
+func NormalizeMappings(in map[string]Mapping) (mappings map[string]Mapping, unknown []string) {
+	mappings = make(map[string]Mapping, len(in))
+	for k, v := range in {
+		if c, ok := ControlID(k); ok {
+			mappings[c] = v
+		} else {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+	return mappings, unknown
+}
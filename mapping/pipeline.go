@@ -0,0 +1,47 @@
+package mapping
+
+import (
+	"github.com/dg1psi/shuttlemidi/devices"
+)
+
+// pipelineBuffer is the number of events buffered for each pipeline. Further events are dropped while it is full
+const pipelineBuffer = 64
+
+// Pipeline is an independent Mapper with its own outputs, which handles the events of the Controls instead of the Mapper
+// started by Run, e.g. to drive one program with the wheel and another one with the buttons
+type Pipeline struct {
+	Controls []devices.Control
+	Mapper   *Mapper
+	Outputs  map[string]devices.MidiController
+}
+
+// MappingControls returns the identifiers of the mappings required to handle the control of the ShuttlExpress
+func MappingControls(c devices.Control) []string {
+	switch c {
+	case devices.Wheel:
+		return []string{ControlWheelUp, ControlWheelDown}
+	case devices.Dial:
+		return []string{ControlDial}
+	}
+	return []string{c.String()}
+}
+
+// startPipelines runs the mappers of the pipelines until quitch is closed. It returns the event channel of the pipeline
+// handling each control and the error channels of all pipelines. A control listed by several pipelines is handled by
+// the first one
+func startPipelines(quitch chan struct{}, pipelines []Pipeline) (map[devices.Control]chan devices.Event, []chan error) {
+	routes := make(map[devices.Control]chan devices.Event)
+	var errs []chan error
+	for _, p := range pipelines {
+		events := make(chan devices.Event, pipelineBuffer)
+		errors := make(chan error, 1)
+		for _, c := range p.Controls {
+			if _, ok := routes[c]; !ok {
+				routes[c] = events
+			}
+		}
+		errs = append(errs, errors)
+		go p.Mapper.run(quitch, events, errors, p.Outputs, nil, nil)
+	}
+	return routes, errs
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dg1psi/shuttlemidi/devices"
+	"github.com/dg1psi/shuttlemidi/mapping"
+)
+
+// PipelineConfig contains the configuration of an independent mapper, which handles a subset of the controls with its
+// own mappings and output
+type PipelineConfig struct {
+	// Controls lists the controls of the ShuttlExpress handled by the pipeline: Wheel, Dial and Button1 to Button5
+	Controls []string
+	// Backend is the name of the backend receiving the commands of the pipeline, see Backends
+	Backend string
+	// Mappings contains the mappings of the controls, using the same identifiers as the main mappings
+	Mappings map[string]mapping.Mapping
+}
+
+// controls returns the controls of the pipeline. Unknown names are skipped
+func (p *PipelineConfig) controls() []devices.Control {
+	var controls []devices.Control
+	for _, name := range p.Controls {
+		var c devices.Control
+		if err := c.UnmarshalText([]byte(strings.Title(strings.ToLower(name)))); err == nil {
+			controls = append(controls, c)
+		}
+	}
+	return controls
+}
+
+// validate checks the controls, backend and mappings of the pipeline with the given name. claimed contains the controls
+// of the pipelines checked before and is updated
+func (p *PipelineConfig) validate(name string, cfg *Config, claimed map[devices.Control]string) error {
+	if len(p.controls()) != len(p.Controls) || len(p.Controls) == 0 {
+		return fmt.Errorf("pipeline %v must list valid controls, e.g. Wheel, Dial or Button1", name)
+	}
+	if _, ok := cfg.Backends[strings.ToLower(p.Backend)]; !ok {
+		return fmt.Errorf("unknown backend %v of pipeline %v", p.Backend, name)
+	}
+	for _, c := range p.controls() {
+		if other, ok := claimed[c]; ok {
+			return fmt.Errorf("control %v of pipeline %v is already handled by pipeline %v", c, name, other)
+		}
+		claimed[c] = name
+		for _, id := range mapping.MappingControls(c) {
+			if _, ok := p.Mappings[id]; !ok {
+				return fmt.Errorf("no mapping configured for %v of pipeline %v", id, name)
+			}
+		}
+	}
+	for c, m := range p.Mappings {
+		if err := m.Validate(c); err != nil {
+			return fmt.Errorf("pipeline %v: %w", name, err)
+		}
+		if err := cfg.validateBackendNames(m, c+" of pipeline "+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pipelines creates the mapping pipelines of the configuration. The default output of each pipeline is its backend,
+// a pipeline whose backend couldn't be opened is skipped and its controls are handled by the main mappings
+func pipelines(cfg *Config, outputs map[string]devices.MidiController) []mapping.Pipeline {
+	var ps []mapping.Pipeline
+	for name, pc := range cfg.Pipelines {
+		out, ok := outputs[strings.ToLower(pc.Backend)]
+		if !ok {
+			fmt.Printf("Error: backend %v of pipeline %v isn't available, skipping it\n", pc.Backend, name)
+			continue
+		}
+		pipeOutputs := make(map[string]devices.MidiController, len(outputs))
+		for k, v := range outputs {
+			pipeOutputs[k] = v
+		}
+		pipeOutputs[""] = out
+		// the pipeline handles its controls like the main Mapper, only the channel is the one of its backend
+		options := mapperOptions(cfg)
+		options.Channel = cfg.Backends[strings.ToLower(pc.Backend)].channel()
+		mapper, err := mapping.NewMapper(pc.Mappings, options)
+		if err != nil {
+			fmt.Printf("Error: pipeline %v: %v, skipping it\n", name, err)
+			continue
+		}
+		ps = append(ps, mapping.Pipeline{Controls: pc.controls(), Mapper: mapper, Outputs: pipeOutputs})
+	}
+	return ps
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dg1psi/shuttlemidi/devices"
+	"github.com/dg1psi/shuttlemidi/mapping"
+	"gitlab.com/gomidi/midi/testdrv"
+)
+
+func TestPipelineOptions(t *testing.T) {
+	cfg := &Config{
+		WheelMax:            7,
+		WheelPositiveInvert: true,
+		WheelNegativeInvert: true,
+		WheelBands:          []mapping.WheelBand{{Max: 2, Up: mapping.Mapping{Controller: 10}, Down: mapping.Mapping{Controller: 11}}},
+		WheelStepRate:       4,
+		Backends:            map[string]BackendConfig{"thetis": {MidiDevice: "thetis", MidiChannel: 3}},
+		Pipelines: map[string]PipelineConfig{"wheel": {
+			Controls: []string{"Wheel"},
+			Backend:  "Thetis",
+			Mappings: map[string]mapping.Mapping{mapping.ControlWheelUp: {}, mapping.ControlWheelDown: {Controller: 1}},
+		}},
+	}
+	out := devices.NewMIDIController(testdrv.New("thetis"), "thetis", 100*time.Millisecond, 2, devices.MidiOptions{})
+	ps := pipelines(cfg, map[string]devices.MidiController{"thetis": out})
+	if len(ps) != 1 {
+		t.Fatalf("%v pipelines created, expected 1", len(ps))
+	}
+	o := ps[0].Mapper.Options
+	if o.Channel != 3 || !o.WheelPositiveInvert || !o.WheelNegativeInvert || len(o.WheelBands) != 1 || o.WheelStepRate != 4 {
+		t.Errorf("pipeline options %+v differ from the configuration", o)
+	}
+}
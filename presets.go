@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dg1psi/shuttlemidi/devices"
+	"github.com/dg1psi/shuttlemidi/mapping"
+	"github.com/spf13/viper"
+)
+
+// preset contains the settings and the complete mappings of a program
+type preset struct {
+	Name     string
+	Settings map[string]interface{}
+	Mappings map[string]interface{}
+}
+
+// presets contains the built-in presets selectable from the tray menu
+var presets = []preset{
+	{
+		Name:     "SDR Console",
+		Settings: map[string]interface{}{"MidiChannel": 1, "DialRepeatWindow": "0s", "WheelPositiveInvert": true, "WheelNegativeInvert": false},
+		Mappings: mappingDefaults,
+	},
+	{
+		Name:     "Thetis",
+		Settings: map[string]interface{}{"MidiChannel": 1, "DialRepeatWindow": "0s", "WheelPositiveInvert": false, "WheelNegativeInvert": false},
+		Mappings: withMappings(mappingDefaults, map[string]interface{}{
+			mapping.ControlWheel: map[string]interface{}{"Name": "VFO", "Controller": 0, "Center": 64, "Step": 9},
+			mapping.ControlDial:  map[string]interface{}{"Name": "VFO Fine", "Controller": 2, "Encoding": mapping.EncodingTwosComplement},
+		}),
+	},
+	{
+		Name:     "Generic DAW",
+		Settings: map[string]interface{}{"MidiChannel": 1, "DialRepeatWindow": "0s", "WheelPositiveInvert": false, "WheelNegativeInvert": false},
+		Mappings: withMappings(mappingDefaults, map[string]interface{}{
+			mapping.ControlDial:    map[string]interface{}{"Name": "Jog", "Controller": 2, "Encoding": mapping.EncodingBinaryOffset},
+			mapping.ControlButton1: map[string]interface{}{"Name": "Pad 1", "Type": mapping.TypeNote, "Note": 36},
+			mapping.ControlButton2: map[string]interface{}{"Name": "Pad 2", "Type": mapping.TypeNote, "Note": 37},
+			mapping.ControlButton3: map[string]interface{}{"Name": "Pad 3", "Type": mapping.TypeNote, "Note": 38},
+			mapping.ControlButton4: map[string]interface{}{"Name": "Pad 4", "Type": mapping.TypeNote, "Note": 39},
+			mapping.ControlButton5: map[string]interface{}{"Name": "Pad 5", "Type": mapping.TypeNote, "Note": 40},
+		}),
+	},
+}
+
+// withMappings returns a copy of base with the mappings of changes added or replaced
+func withMappings(base map[string]interface{}, changes map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(base)+len(changes))
+	for k, v := range base {
+		result[k] = v
+	}
+	for k, v := range changes {
+		result[k] = v
+	}
+	return result
+}
+
+// presetNames returns the names of all presets
+func presetNames() []string {
+	names := make([]string, 0, len(presets))
+	for _, p := range presets {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// findPreset returns the preset matching name case-insensitively
+func findPreset(name string) (preset, bool) {
+	for _, p := range presets {
+		if strings.EqualFold(p.Name, name) {
+			return p, true
+		}
+	}
+	return preset{}, false
+}
+
+// applyPreset replaces the settings and all mappings by the preset, stores it as active preset and writes the
+// configuration
+func applyPreset(p preset) error {
+	// the controller range of the previous program doesn't apply, unless the preset sets its own
+	viper.Set("ControllerRange", configDefaults["ControllerRange"])
+	for k, v := range p.Settings {
+		viper.Set(k, v)
+	}
+	viper.Set("Mappings", p.Mappings)
+	viper.Set("Preset", p.Name)
+	_, err := saveConfig()
+	return err
+}
+
+// selectPreset applies the preset with the given name like the tray menu, reloads the configuration and restarts the
+// listeners with it. The MIDI device selected in the tray is kept
+func selectPreset(name string, se *devices.ShuttlExpress) error {
+	p, ok := findPreset(name)
+	if !ok {
+		return fmt.Errorf("unknown preset %v", name)
+	}
+	saveErr := applyPreset(p)
+	cfg, err := reloadConfig()
+	startListeners(cfg, cfg.MidiDevice, se)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	if saveErr != nil {
+		return fmt.Errorf("unable to save the preset: %w", saveErr)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dg1psi/shuttlemidi/devices"
+)
+
+// PresetSwitchConfig contains the MIDI input and the rules selecting a preset when the host sends a program change or
+// control change message, e.g. when the mode of the SDR changes
+type PresetSwitchConfig struct {
+	// MidiDevice is the name of the MIDI input device the host sends to. An empty string disables the preset switching
+	MidiDevice string
+	// Rules are checked in order, the first rule matching a message selects its preset
+	Rules []PresetRule
+}
+
+// PresetRule selects a preset when a matching message is received
+type PresetRule struct {
+	// Type is the type of the message, ProgramChange or ControlChange
+	Type string
+	// Channel is the MIDI channel (1-16) of the message. 0 matches any channel
+	Channel uint8
+	// Number is the program number or the controller number
+	Number uint8
+	// Value is the controller value. It is ignored for program changes
+	Value uint8
+	// Preset is the name of the preset selected
+	Preset string
+}
+
+// matches returns true if the command received from the MIDI input matches the rule
+func (r *PresetRule) matches(cmd devices.Command) bool {
+	if !strings.EqualFold(r.Type, cmd.Type.String()) || (r.Channel != 0 && r.Channel != cmd.Channel) || r.Number != cmd.Data1 {
+		return false
+	}
+	return cmd.Type == devices.ProgramChange || r.Value == cmd.Data2
+}
+
+// validate checks the message types, ranges and presets of the rules
+func (ps *PresetSwitchConfig) validate() error {
+	for i, r := range ps.Rules {
+		if !strings.EqualFold(r.Type, devices.ProgramChange.String()) && !strings.EqualFold(r.Type, devices.ControlChange.String()) {
+			return fmt.Errorf("type %v of PresetSwitch rule %v must be ProgramChange or ControlChange", r.Type, i+1)
+		}
+		if r.Channel > 16 || r.Number > 127 || r.Value > 127 {
+			return fmt.Errorf("channel, number or value of PresetSwitch rule %v is out of range", i+1)
+		}
+		if _, ok := findPreset(r.Preset); !ok {
+			return fmt.Errorf("unknown preset %v of PresetSwitch rule %v", r.Preset, i+1)
+		}
+	}
+	return nil
+}
+
+// presetInput is the MIDI input opened by startPresetSwitch
+var presetInput *devices.MidiInput
+
+// startPresetSwitch opens the MIDI input of PresetSwitch and selects the preset of the first rule matching a message
+// received, unless it is already active. The input is kept open when the configuration is reloaded, changes of
+// PresetSwitch apply after a restart
+func startPresetSwitch(cfg *Config, se *devices.ShuttlExpress) {
+	ps := cfg.PresetSwitch
+	if ps.MidiDevice == "" || len(ps.Rules) == 0 {
+		return
+	}
+
+	// the driver must not be blocked while a preset is applied, messages received meanwhile are dropped
+	cmdch := make(chan devices.Command, 16)
+	presetInput = devices.NewMIDIInput(nil, ps.MidiDevice, cfg.MidiExactMatch)
+	err := presetInput.Open(func(cmd devices.Command) {
+		select {
+		case cmdch <- cmd:
+		default:
+		}
+	})
+	if err != nil {
+		fmt.Printf("Error: unable to open the PresetSwitch input: %v\n", err)
+		presetInput = nil
+		return
+	}
+
+	go func() {
+		for cmd := range cmdch {
+			for _, r := range ps.Rules {
+				if !r.matches(cmd) {
+					continue
+				}
+				if !strings.EqualFold(r.Preset, currentConfig().Preset) {
+					fmt.Printf("Switching to preset %v\n", r.Preset)
+					if err := selectPreset(r.Preset, se); err != nil {
+						fmt.Printf("Error: %v\n", err)
+					}
+				}
+				break
+			}
+		}
+	}()
+}
+
+// stopPresetSwitch closes the MIDI input of PresetSwitch
+func stopPresetSwitch() {
+	if presetInput != nil {
+		presetInput.Close()
+		presetInput = nil
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dg1psi/shuttlemidi/devices"
+)
+
+func TestPresetRuleMatches(t *testing.T) {
+	program := PresetRule{Type: "ProgramChange", Number: 5, Preset: "Thetis"}
+	cc := PresetRule{Type: "controlchange", Channel: 2, Number: 20, Value: 3, Preset: "Thetis"}
+	tests := []struct {
+		name    string
+		rule    PresetRule
+		cmd     devices.Command
+		matches bool
+	}{
+		{"program any channel", program, devices.Command{Type: devices.ProgramChange, Channel: 9, Data1: 5}, true},
+		{"other program", program, devices.Command{Type: devices.ProgramChange, Channel: 9, Data1: 6}, false},
+		{"control change as program", program, devices.Command{Type: devices.ControlChange, Channel: 9, Data1: 5}, false},
+		{"control change", cc, devices.Command{Type: devices.ControlChange, Channel: 2, Data1: 20, Data2: 3}, true},
+		{"other value", cc, devices.Command{Type: devices.ControlChange, Channel: 2, Data1: 20, Data2: 4}, false},
+		{"other channel", cc, devices.Command{Type: devices.ControlChange, Channel: 1, Data1: 20, Data2: 3}, false},
+	}
+	for _, tt := range tests {
+		if tt.rule.matches(tt.cmd) != tt.matches {
+			t.Errorf("%v: matches is %v, expected %v", tt.name, !tt.matches, tt.matches)
+		}
+	}
+}
+
+func TestPresetSwitchValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  PresetRule
+		valid bool
+	}{
+		{"program", PresetRule{Type: "ProgramChange", Number: 5, Preset: "thetis"}, true},
+		{"note", PresetRule{Type: "NoteOn", Number: 5, Preset: "Thetis"}, false},
+		{"channel 17", PresetRule{Type: "ControlChange", Channel: 17, Number: 20, Preset: "Thetis"}, false},
+		{"value 128", PresetRule{Type: "ControlChange", Number: 20, Value: 128, Preset: "Thetis"}, false},
+		{"unknown preset", PresetRule{Type: "ControlChange", Number: 20, Preset: "Unknown"}, false},
+	}
+	for _, tt := range tests {
+		ps := PresetSwitchConfig{MidiDevice: "Host Port", Rules: []PresetRule{tt.rule}}
+		if err := ps.validate(); (err == nil) != tt.valid {
+			t.Errorf("%v: validate returned %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dg1psi/shuttlemidi/devices"
+	"github.com/gen2brain/dlgs"
+)
+
+// selfTest checks that the ShuttlExpress delivers at least one report within timeout and that a message can be written
+// to the MIDI device. The result is logged and shown in a dialog
+func selfTest(se *devices.ShuttlExpress, mc devices.MidiController, timeout time.Duration) {
+	fmt.Printf("Self-test: move any control of the ShuttlExpress within %v\n", timeout)
+	hid := "PASS"
+	start := se.Reports()
+	deadline := time.Now().Add(timeout)
+	for se.Reports() == start {
+		if time.Now().After(deadline) {
+			hid = "FAIL (no report received within " + timeout.String() + ")"
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	midi := "PASS"
+	if err := mc.Test(); err != nil {
+		midi = "FAIL (" + err.Error() + ")"
+	}
+
+	result := fmt.Sprintf("ShuttlExpress: %v\nMIDI %v: %v", hid, mc.Port(), midi)
+	fmt.Printf("Self-test:\n%v\n", result)
+	dlgs.Info(applicationName, "Self-test\n"+result)
+}
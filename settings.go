@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dg1psi/shuttlemidi/mapping"
+	"github.com/gen2brain/dlgs"
+	"github.com/spf13/viper"
+)
+
+// settingsDone is the entry of the control list finishing editSettings
+const settingsDone = "Save and close"
+
+// describeMapping returns a short description of the message sent by the mapping for the control list of editSettings
+func describeMapping(control string, m mapping.Mapping) string {
+	if strings.EqualFold(m.Type, mapping.TypeNote) {
+		return fmt.Sprintf("%v: %v (note %v)", control, m.Name, m.Note)
+	}
+	t := m.Type
+	if t == "" {
+		t = mapping.TypeControlChange
+	}
+	return fmt.Sprintf("%v: %v (%v %v)", control, m.Name, t, m.Controller)
+}
+
+// askNumber asks for a number between 0 and max, which is preset with value. ok is false if the user canceled
+func askNumber(text string, value uint8, max int) (n uint8, ok bool, err error) {
+	for {
+		s, ok, err := dlgs.Entry(applicationName, text, strconv.Itoa(int(value)))
+		if err != nil || !ok {
+			return 0, false, err
+		}
+		if v, err := strconv.Atoi(strings.TrimSpace(s)); err == nil && v >= 0 && v <= max {
+			return uint8(v), true, nil
+		}
+		dlgs.Error(applicationName, fmt.Sprintf("Invalid number %v, expected 0 to %v.", s, max))
+	}
+}
+
+// editSettings shows a sequence of dialogs selecting the MIDI device, the MIDI channel and the message type and number
+// of the mappings. The changes are written to the configuration once the user selects settingsDone, canceling any
+// dialog discards them. ok is false if the settings were canceled
+func editSettings(cfg *Config, devs []string) (ok bool, err error) {
+	settings := make(map[string]interface{})
+	if len(devs) > 0 {
+		device, ok, err := dlgs.List(applicationName, fmt.Sprintf("MIDI device (currently %v):", cfg.MidiDevice), devs)
+		if err != nil || !ok {
+			return false, err
+		}
+		settings["MidiDevice"] = device
+	}
+	channels := make([]string, 16)
+	for i := range channels {
+		channels[i] = strconv.Itoa(i + 1)
+	}
+	channel, ok, err := dlgs.List(applicationName, fmt.Sprintf("MIDI channel (currently %v):", cfg.MidiChannel), channels)
+	if err != nil || !ok {
+		return false, err
+	}
+	settings["MidiChannel"], _ = strconv.Atoi(channel)
+
+	mappings := make(map[string]mapping.Mapping, len(cfg.Mappings))
+	for k, m := range cfg.Mappings {
+		mappings[k] = m
+	}
+	changed := make(map[string]bool)
+	for {
+		// the required controls first, followed by the optional mappings configured
+		controls := append([]string{}, mapping.Controls...)
+		for _, c := range mapping.OptionalControls {
+			if _, ok := mappings[c]; ok {
+				controls = append(controls, c)
+			}
+		}
+		labels := make([]string, 0, len(controls)+1)
+		byLabel := make(map[string]string, len(controls))
+		for _, c := range controls {
+			label := describeMapping(c, mappings[c])
+			labels = append(labels, label)
+			byLabel[label] = c
+		}
+		labels = append(labels, settingsDone)
+
+		selected, ok, err := dlgs.List(applicationName, "Select a mapping to change or \""+settingsDone+"\":", labels)
+		if err != nil || !ok {
+			return false, err
+		}
+		if selected == settingsDone {
+			break
+		}
+		control := byLabel[selected]
+		m := mappings[control]
+
+		if strings.HasPrefix(control, "Button") {
+			types := []string{mapping.TypeControlChange, mapping.TypeNote, mapping.TypeCounter}
+			t, ok, err := dlgs.List(applicationName, "Message type of "+control+":", types)
+			if err != nil || !ok {
+				return false, err
+			}
+			m.Type = t
+		}
+		if strings.EqualFold(m.Type, mapping.TypeNote) {
+			if m.Note, ok, err = askNumber("Note number of "+control+" (0-127):", m.Note, 127); err != nil || !ok {
+				return false, err
+			}
+		} else if m.Controller, ok, err = askNumber("Controller number of "+control+" (0-127):", m.Controller, 127); err != nil || !ok {
+			return false, err
+		}
+		mappings[control] = m
+		changed[control] = true
+	}
+
+	for k, v := range settings {
+		viper.Set(k, v)
+	}
+	for c := range changed {
+		m := mappings[c]
+		viper.Set("Mappings."+c+".Type", m.Type)
+		viper.Set("Mappings."+c+".Controller", m.Controller)
+		viper.Set("Mappings."+c+".Note", m.Note)
+	}
+	_, err = saveConfig()
+	return true, err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/dg1psi/shuttlemidi/mapping"
+	"github.com/spf13/viper"
+)
+
+// stateFile returns the path of the file the runtime state is persisted to, next to the configuration file
+func stateFile() string {
+	return filepath.Join(filepath.Dir(viper.ConfigFileUsed()), "state.json")
+}
+
+// loadState returns the runtime state persisted by saveState. An empty state is returned if PersistState is disabled
+// or the file can't be read
+func loadState(cfg *Config) mapping.State {
+	var state mapping.State
+	if !cfg.PersistState {
+		return state
+	}
+	data, err := os.ReadFile(stateFile())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("Error: %v\n", err)
+		}
+		return state
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		fmt.Printf("Error: invalid state file %v: %v\n", stateFile(), err)
+		return mapping.State{}
+	}
+	return state
+}
+
+// onState returns the OnState callback of the Mapper saving the state, nil if PersistState is disabled
+func onState(cfg *Config) func(state mapping.State) {
+	if !cfg.PersistState {
+		return nil
+	}
+	return saveState
+}
+
+// saveState writes the runtime state to the state file
+func saveState(state mapping.State) {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		err = os.WriteFile(stateFile(), data, 0644)
+	}
+	if err != nil {
+		fmt.Printf("Error: unable to save the state: %v\n", err)
+	}
+}
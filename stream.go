@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dg1psi/shuttlemidi/devices"
+)
+
+// websocketGUID is appended to the key of the client to calculate the accept key of the WebSocket handshake (RFC 6455)
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// streamBuffer is the number of messages queued per client. Further messages are dropped for a slow client
+const streamBuffer = 64
+
+// streamMessage is the JSON representation of an event or command streamed by the /events endpoint
+type streamMessage struct {
+	Kind    string         `json:"kind"` // "event" or "command"
+	Event   *devices.Event `json:"event,omitempty"`
+	Output  string         `json:"output,omitempty"`
+	Command *streamCommand `json:"command,omitempty"`
+	Time    time.Time      `json:"time"`
+}
+
+// streamCommand is the JSON representation of a devices.Command streamed by the /events endpoint
+type streamCommand struct {
+	Name    string              `json:"name"`
+	Type    devices.MessageType `json:"type"`
+	Channel uint8               `json:"channel"`
+	Data1   uint8               `json:"data1"`
+	Data2   uint8               `json:"data2"`
+	Repeat  bool                `json:"repeat"`
+}
+
+// eventStream distributes the streamed messages to all connected clients
+type eventStream struct {
+	mu      sync.Mutex
+	clients map[chan []byte]struct{}
+}
+
+// stream is the eventStream of the /events endpoint, fed by the Mapper
+var stream = &eventStream{clients: make(map[chan []byte]struct{})}
+
+// subscribe returns a new channel receiving all messages published afterwards
+func (es *eventStream) subscribe() chan []byte {
+	ch := make(chan []byte, streamBuffer)
+	es.mu.Lock()
+	es.clients[ch] = struct{}{}
+	es.mu.Unlock()
+	return ch
+}
+
+// unsubscribe stops sending messages to the channel
+func (es *eventStream) unsubscribe(ch chan []byte) {
+	es.mu.Lock()
+	delete(es.clients, ch)
+	es.mu.Unlock()
+}
+
+// publish sends the message to all clients without blocking. Nothing is encoded if no client is connected
+func (es *eventStream) publish(msg streamMessage) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if len(es.clients) == 0 {
+		return
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	for ch := range es.clients {
+		select {
+		case ch <- data:
+		default:
+		}
+	}
+}
+
+// publishEvent streams an event of the ShuttlExpress
+func (es *eventStream) publishEvent(e devices.Event) {
+	es.publish(streamMessage{Kind: "event", Event: &e, Time: e.Time})
+}
+
+// publishCommand streams a command sent to the output backend
+func (es *eventStream) publishCommand(output string, cmd devices.Command) {
+	es.publish(streamMessage{Kind: "command", Output: output, Time: time.Now(),
+		Command: &streamCommand{Name: cmd.Name, Type: cmd.Type, Channel: cmd.Channel, Data1: cmd.Data1, Data2: cmd.Data2, Repeat: cmd.Repeat}})
+}
+
+// streamEvents returns the OnEvent callback of the Mapper publishing the events, nil if the stream is disabled
+func streamEvents(cfg *Config) func(e devices.Event) {
+	if !cfg.API.Enabled || !cfg.API.Stream {
+		return nil
+	}
+	return stream.publishEvent
+}
+
+// streamCommands returns the OnSend callback of the Mapper publishing the commands, nil if the stream is disabled
+func streamCommands(cfg *Config) func(output string, cmd devices.Command) {
+	if !cfg.API.Enabled || !cfg.API.Stream {
+		return nil
+	}
+	return stream.publishCommand
+}
+
+// WebSocket opcodes (RFC 6455)
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+)
+
+// wsFrame is a WebSocket frame received from the client. The payload is only read for control frames
+type wsFrame struct {
+	opcode  byte
+	payload []byte
+}
+
+// writeFrame writes data as a single unmasked WebSocket frame with the given opcode
+func writeFrame(w io.Writer, opcode byte, data []byte) error {
+	header := []byte{0x80 | opcode, 0}
+	switch n := len(data); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = append(header, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readFrame reads a WebSocket frame of the client. The payload of data frames is discarded, the payload of control
+// frames is unmasked. Control frames longer than 125 bytes are rejected as protocol error
+func readFrame(r io.Reader) (wsFrame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return wsFrame{}, err
+	}
+	f := wsFrame{opcode: header[0] & 0x0F}
+	masked := header[1]&0x80 != 0
+	n := uint64(header[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return f, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return f, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return f, err
+		}
+	}
+
+	if f.opcode < wsClose {
+		_, err := io.CopyN(io.Discard, r, int64(n))
+		return f, err
+	}
+	if n > 125 {
+		return f, errors.New("WebSocket control frame too long")
+	}
+	f.payload = make([]byte, n)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return f, err
+	}
+	if masked {
+		for i := range f.payload {
+			f.payload[i] ^= mask[i%4]
+		}
+	}
+	return f, nil
+}
+
+// handleEvents upgrades the request to a WebSocket and streams the events of the ShuttlExpress and the commands sent
+// as JSON text messages. Pings of the client are answered, its data messages are discarded. The stream ends when the
+// client sends a close frame, which is echoed, or disconnects
+func handleEvents(es *eventStream) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+			http.Error(w, "WebSocket upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+			return
+		}
+		conn, rw, err := hj.Hijack()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		defer conn.Close()
+
+		sum := sha1.Sum([]byte(key + websocketGUID))
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %v\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+		if err := rw.Flush(); err != nil {
+			return
+		}
+
+		ch := es.subscribe()
+		defer es.unsubscribe(ch)
+
+		// the frames of the client are read by a separate goroutine, the control frames are answered by this one, as
+		// it writes all frames. closed is closed if the connection fails, done once this handler returns
+		control := make(chan wsFrame)
+		closed := make(chan struct{})
+		done := make(chan struct{})
+		defer close(done)
+		go func(r *bufio.Reader) {
+			defer close(closed)
+			for {
+				f, err := readFrame(r)
+				if err != nil {
+					return
+				}
+				if f.opcode == wsPing || f.opcode == wsClose {
+					select {
+					case control <- f:
+					case <-done:
+						return
+					}
+				}
+				if f.opcode == wsClose {
+					return
+				}
+			}
+		}(rw.Reader)
+
+		for {
+			select {
+			case data := <-ch:
+				if err := writeFrame(conn, wsText, data); err != nil {
+					return
+				}
+			case f := <-control:
+				if f.opcode == wsPing {
+					if err := writeFrame(conn, wsPong, f.payload); err != nil {
+						return
+					}
+					continue
+				}
+				// the close frame is echoed with the status code of the client before the connection is closed
+				if len(f.payload) > 2 {
+					f.payload = f.payload[:2]
+				}
+				writeFrame(conn, wsClose, f.payload)
+				return
+			case <-closed:
+				return
+			}
+		}
+	}
+}
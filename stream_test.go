@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dg1psi/shuttlemidi/devices"
+)
+
+// writeMaskedFrame writes a masked WebSocket frame like a client
+func writeMaskedFrame(w io.Writer, opcode byte, data []byte) error {
+	mask := []byte{1, 2, 3, 4}
+	frame := append([]byte{0x80 | opcode, 0x80 | byte(len(data))}, mask...)
+	for i, b := range data {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// readServerFrame reads an unmasked frame of the server with a payload below 126 bytes
+func readServerFrame(r io.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, header[1]&0x7F)
+	_, err := io.ReadFull(r, payload)
+	return header[0] & 0x0F, payload, err
+}
+
+func TestHandleEventsControlFrames(t *testing.T) {
+	es := &eventStream{clients: make(map[chan []byte]struct{})}
+	srv := httptest.NewServer(handleEvents(es))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET /events HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake failed: %v %v", resp.Status, resp.Header)
+	}
+
+	// data messages of the client are discarded, pings are answered with their payload
+	if err := writeMaskedFrame(conn, wsText, []byte("ignored")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMaskedFrame(conn, wsPing, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if opcode, payload, err := readServerFrame(r); err != nil || opcode != wsPong || string(payload) != "ping" {
+		t.Fatalf("received opcode %v with %q (%v), expected a pong", opcode, payload, err)
+	}
+	if err := writeMaskedFrame(conn, wsPong, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	es.publishEvent(devices.Event{Control: devices.Button1, Value: 1})
+	if opcode, payload, err := readServerFrame(r); err != nil || opcode != wsText || !bytes.Contains(payload, []byte(`"Button1"`)) {
+		t.Fatalf("received opcode %v with %q (%v), expected the event", opcode, payload, err)
+	}
+
+	// the close frame is echoed with the status code and the connection is closed
+	if err := writeMaskedFrame(conn, wsClose, []byte{0x03, 0xE8, 'b', 'y', 'e'}); err != nil {
+		t.Fatal(err)
+	}
+	if opcode, payload, err := readServerFrame(r); err != nil || opcode != wsClose || !bytes.Equal(payload, []byte{0x03, 0xE8}) {
+		t.Fatalf("received opcode %v with % X (%v), expected a close frame with 1000", opcode, payload, err)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("connection not closed: %v", err)
+	}
+}
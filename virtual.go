@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dg1psi/shuttlemidi/devices"
+)
+
+// runVirtualInput feeds the events of the script at path into the virtual ShuttlExpress se. "-" reads the script from
+// the standard input
+func runVirtualInput(se *devices.ShuttlExpress, path string) {
+	r := io.Reader(os.Stdin)
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		defer f.Close()
+		r = f
+	}
+	if err := runScript(se, r); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+}
+
+// runScript reads virtual events from r, one per line. A line contains a control and its value (e.g. "Wheel 3",
+// "Dial -1" or "Button1 1") or a pause (e.g. "Sleep 500ms"). Empty lines and lines starting with # are ignored
+func runScript(se *devices.ShuttlExpress, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("line %v: expected a control and a value", line)
+		}
+
+		if strings.EqualFold(fields[0], "Sleep") {
+			d, err := time.ParseDuration(fields[1])
+			if err != nil {
+				return fmt.Errorf("line %v: %v", line, err)
+			}
+			time.Sleep(d)
+			continue
+		}
+
+		var c devices.Control
+		if err := c.UnmarshalText([]byte(fields[0])); err != nil {
+			return fmt.Errorf("line %v: %v", line, err)
+		}
+		value, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return fmt.Errorf("line %v: %v", line, err)
+		}
+		se.Simulate(c, value)
+	}
+	return scanner.Err()
+}